@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"SOCKS5-proxy/socks5"
+)
+
+// config настройки прокси. Значения по умолчанию переопределяются файлом
+// конфигурации, а его значения - явно заданными флагами
+type config struct {
+	ConfigFile  string `yaml:"-"`
+	CheckConfig bool   `yaml:"-"`
+
+	Listen listenConfig `yaml:"listen"`
+	// Несколько листенеров со своими настройками; если заданы, listen не используется
+	Listeners  []listenConfig `yaml:"listeners"`
+	Egress     egressConfig   `yaml:"egress"`
+	Engine     string         `yaml:"engine"`
+	EpollLoops int            `yaml:"epoll_loops"`
+	Timeouts   timeoutsConfig `yaml:"timeouts"`
+	Auth       authConfig     `yaml:"auth"`
+	RulesFile  string         `yaml:"rules_file"`
+	Rules      []string       `yaml:"rules"`
+	DNS        dnsConfig      `yaml:"dns"`
+	Upstream   listValue      `yaml:"upstream"`
+	RoutesFile string         `yaml:"routes_file"`
+	// Подмены адресов назначения: файл или список в формате файла
+	RewritesFile string          `yaml:"rewrites_file"`
+	Rewrites     []string        `yaml:"rewrites"`
+	Limits       limitsConfig    `yaml:"limits"`
+	Bandwidth    bandwidthConfig `yaml:"bandwidth"`
+	AccessLog    accessLogConfig `yaml:"access_log"`
+	Metrics      string          `yaml:"metrics_listen"`
+	Admin        string          `yaml:"admin_listen"`
+}
+
+// listenConfig адрес приёма соединений и настройки сессий листенера
+type listenConfig struct {
+	Name    string    `yaml:"name"`
+	Address string    `yaml:"address"`
+	Port    string    `yaml:"port"`
+	TLS     tlsConfig `yaml:"tls"`
+	Egress  listValue `yaml:"egress"` // исходящие адреса сессий листенера
+}
+
+type tlsConfig struct {
+	Cert              string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// egressConfig исходящие адреса подключений к целям: общие и по пользователям
+type egressConfig struct {
+	Addresses listValue           `yaml:"addresses"`
+	Users     map[string][]string `yaml:"users"`
+}
+
+type timeoutsConfig struct {
+	Handshake     time.Duration `yaml:"handshake"`
+	Dial          time.Duration `yaml:"dial"`
+	IdleUp        time.Duration `yaml:"idle_up"`
+	IdleDown      time.Duration `yaml:"idle_down"`
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+}
+
+// authConfig пользователи из файла и из самой конфигурации; при совпадении
+// имён действует запись из конфигурации
+type authConfig struct {
+	File        string            `yaml:"file"`
+	Users       map[string]string `yaml:"users"` // имя -> bcrypt-хэш пароля
+	AllowNoAuth bool              `yaml:"allow_noauth"`
+}
+
+type dnsConfig struct {
+	Servers listValue     `yaml:"servers"`
+	TCP     bool          `yaml:"tcp"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type limitsConfig struct {
+	MaxSessions int     `yaml:"max_sessions"`
+	MaxPerIP    int     `yaml:"max_sessions_per_ip"`
+	Rate        float64 `yaml:"max_conn_rate"`
+}
+
+type accessLogConfig struct {
+	File    string `yaml:"file"`
+	MaxMB   int64  `yaml:"max_mb"`
+	Backups int    `yaml:"backups"`
+}
+
+// bandwidthConfig ограничения скорости по направлениям
+type bandwidthConfig struct {
+	RateUp         socks5.ByteRate `yaml:"rate_up"`
+	RateDown       socks5.ByteRate `yaml:"rate_down"`
+	ClientRateUp   socks5.ByteRate `yaml:"client_rate_up"`
+	ClientRateDown socks5.ByteRate `yaml:"client_rate_down"`
+	UserRateUp     socks5.ByteRate `yaml:"user_rate_up"`
+	UserRateDown   socks5.ByteRate `yaml:"user_rate_down"`
+}
+
+// listValue список строк; во флаге задаётся через запятую
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// bindFlags флаги командной строки, записывающие значения в cfg
+func bindFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.ConfigFile, "config", "", "YAML configuration file; flags given explicitly override its values")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", false, "Validate the configuration and exit")
+	fs.StringVar(&cfg.Listen.Port, "port", "8080", "Port to listen on")
+	fs.StringVar(&cfg.Listen.Address, "listen", "", "IPv4 or IPv6 address to listen on (all interfaces, both stacks, if empty)")
+	fs.StringVar(&cfg.Auth.File, "auth-file", "", "File with \"user:bcrypt-hash\" lines; enables username/password auth")
+	fs.BoolVar(&cfg.Auth.AllowNoAuth, "allow-noauth", false, "Also accept clients without credentials when users are configured")
+	fs.Var(&cfg.DNS.Servers, "dns", "Comma-separated DNS servers for the caching resolver (system resolver if empty)")
+	fs.BoolVar(&cfg.DNS.TCP, "dns-tcp", false, "Query DNS servers over TCP only")
+	fs.DurationVar(&cfg.DNS.Timeout, "dns-timeout", 2*time.Second, "Timeout of a single DNS query (must be positive)")
+	fs.Var(&cfg.Upstream, "upstream", "Default chain of upstream proxies, comma-separated socks5:// or http:// URLs")
+	fs.StringVar(&cfg.RoutesFile, "routes", "", "File with per-destination upstream chains")
+	fs.StringVar(&cfg.RewritesFile, "rewrites", "", "File with destination rewrites \"pattern[:port] target[:port]\" for CONNECT requests")
+	fs.StringVar(&cfg.RulesFile, "rules", "", "File with access rules (everything is allowed if empty)")
+	fs.DurationVar(&cfg.Timeouts.Handshake, "handshake-timeout", 30*time.Second, "Time allowed for greeting, authentication and request (0 disables)")
+	fs.DurationVar(&cfg.Timeouts.Dial, "dial-timeout", 30*time.Second, "Time allowed to connect to the target, including upstream proxies (0 disables)")
+	fs.DurationVar(&cfg.Timeouts.IdleUp, "idle-timeout-up", 5*time.Minute, "Close a tunnel when the client sends nothing for this long, regardless of target traffic (0 disables)")
+	fs.DurationVar(&cfg.Timeouts.IdleDown, "idle-timeout-down", 5*time.Minute, "Close a tunnel when the target sends nothing for this long, regardless of client traffic (0 disables)")
+	fs.DurationVar(&cfg.Timeouts.ShutdownGrace, "shutdown-grace", 30*time.Second, "Time active sessions get to finish after SIGTERM/SIGINT before being closed")
+	fs.StringVar(&cfg.Engine, "engine", socks5.EngineGoroutine, "Connection engine: \"goroutine\" (one per connection) or \"epoll\" (Linux event loops)")
+	fs.IntVar(&cfg.EpollLoops, "epoll-loops", 0, "Number of event loops for the epoll engine (0 is one per CPU)")
+	fs.StringVar(&cfg.AccessLog.File, "access-log", "", "File for the JSON-lines access log, one record per session (disabled if empty)")
+	fs.Int64Var(&cfg.AccessLog.MaxMB, "access-log-max-mb", 100, "Size in megabytes after which the access log is rotated (0 disables rotation)")
+	fs.IntVar(&cfg.AccessLog.Backups, "access-log-backups", 5, "Number of rotated access log files to keep")
+	fs.Var(&cfg.Bandwidth.RateUp, "rate-up", "Total client-to-target bandwidth in bytes/s, K/M/G suffixes allowed (0 is unlimited)")
+	fs.Var(&cfg.Bandwidth.RateDown, "rate-down", "Total target-to-client bandwidth in bytes/s (0 is unlimited)")
+	fs.Var(&cfg.Bandwidth.ClientRateUp, "client-rate-up", "Upload bandwidth per client IP in bytes/s (0 is unlimited)")
+	fs.Var(&cfg.Bandwidth.ClientRateDown, "client-rate-down", "Download bandwidth per client IP in bytes/s (0 is unlimited)")
+	fs.Var(&cfg.Bandwidth.UserRateUp, "user-rate-up", "Upload bandwidth per authenticated user in bytes/s (0 is unlimited)")
+	fs.Var(&cfg.Bandwidth.UserRateDown, "user-rate-down", "Download bandwidth per authenticated user in bytes/s (0 is unlimited)")
+	fs.IntVar(&cfg.Limits.MaxSessions, "max-sessions", 0, "Maximum number of concurrent sessions (0 is unlimited)")
+	fs.IntVar(&cfg.Limits.MaxPerIP, "max-sessions-per-ip", 0, "Maximum number of concurrent sessions from one client IP (0 is unlimited)")
+	fs.Float64Var(&cfg.Limits.Rate, "max-conn-rate", 0, "Maximum number of new connections per second (0 is unlimited)")
+	fs.StringVar(&cfg.Listen.TLS.Cert, "tls-cert", "", "Server certificate file in PEM; enables TLS on the listener together with -tls-key")
+	fs.StringVar(&cfg.Listen.TLS.Key, "tls-key", "", "Server private key file in PEM")
+	fs.StringVar(&cfg.Listen.TLS.ClientCA, "tls-client-ca", "", "CA certificates in PEM to verify client certificates; the certificate subject becomes the user")
+	fs.BoolVar(&cfg.Listen.TLS.RequireClientCert, "tls-require-client-cert", false, "Reject TLS clients without a valid certificate (requires -tls-client-ca)")
+	fs.Var(&cfg.Egress.Addresses, "egress", "Comma-separated source addresses for outgoing connections, used round-robin (kernel choice if empty)")
+	fs.StringVar(&cfg.Metrics, "metrics-listen", "", "Address of the HTTP listener serving Prometheus /metrics, e.g. 127.0.0.1:9100 (disabled if empty)")
+	fs.StringVar(&cfg.Admin, "admin-listen", "", "Address of the unauthenticated admin HTTP API, e.g. 127.0.0.1:9101 (disabled if empty)")
+}
+
+// loadConfig чтение настроек: значения по умолчанию, файл path (если задан)
+// и флаги args поверх него
+func loadConfig(path string, args []string) (*config, error) {
+	cfg := &config{}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bindFlags(fs, cfg)
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -1,3 +1,9 @@
 module SOCKS5-proxy
 
 go 1.23
+
+require golang.org/x/crypto v0.32.0
+
+require golang.org/x/net v0.34.0
+
+require gopkg.in/yaml.v3 v3.0.1
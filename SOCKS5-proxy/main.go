@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"SOCKS5-proxy/socks5"
+)
+
+func main() {
+	cfg := &config{}
+	bindFlags(flag.CommandLine, cfg)
+	flag.Parse()
+
+	if cfg.ConfigFile != "" {
+		var err error
+		cfg, err = loadConfig(cfg.ConfigFile, os.Args[1:])
+		if err != nil {
+			log.Fatalf("Error loading configuration: %v", err)
+		}
+	}
+
+	srv, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	specs, err := newListeners(cfg)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if cfg.CheckConfig {
+		log.Printf("Configuration is valid")
+		return
+	}
+
+	if cfg.AccessLog.File != "" {
+		srv.AccessLog, err = socks5.OpenAccessLog(cfg.AccessLog.File, cfg.AccessLog.MaxMB<<20, cfg.AccessLog.Backups)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer srv.AccessLog.Close()
+		log.Printf("Writing access log to %s", cfg.AccessLog.File)
+	}
+
+	if cfg.Metrics != "" {
+		err = serveMetrics(cfg.Metrics, srv.MetricsHandler())
+		if err != nil {
+			log.Fatalf("Error starting metrics listener: %v", err)
+		}
+	}
+
+	if cfg.Admin != "" {
+		err = serveAdmin(cfg.Admin, srv.AdminHandler())
+		if err != nil {
+			log.Fatalf("Error starting admin listener: %v", err)
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		listener, err := net.Listen("tcp", spec.address)
+		if err != nil {
+			log.Printf("Error opening %s: %v", spec.address, err)
+			for _, l := range listeners {
+				l.Close()
+			}
+			return
+		}
+		listeners = append(listeners, listener)
+		log.Printf("Listening on %s%s", listener.Addr().String(), spec.describe())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reload(srv, cfg.ConfigFile)
+		}
+	}()
+
+	for i, listener := range listeners {
+		go func(listener net.Listener, policy *socks5.ListenerPolicy) {
+			err := srv.ServeWithPolicy(listener, policy)
+			if !errors.Is(err, socks5.ErrServerClosed) {
+				log.Fatalf("Error serving connections: %v", err)
+			}
+		}(listener, specs[i].policy)
+	}
+
+	sig := <-signals
+	log.Printf("Received %v", sig)
+
+	// Повторный сигнал прерывает ожидание активных сессий
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.ShutdownGrace)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v again, closing remaining sessions", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	_ = srv.Shutdown(ctx)
+}
+
+// newServer создание прокси по настройкам без открытия листенера и журнала доступа.
+// Используется и для проверки конфигурации
+func newServer(cfg *config) (*socks5.Server, error) {
+	srv := &socks5.Server{
+		Engine:     cfg.Engine,
+		EpollLoops: cfg.EpollLoops,
+		Timeouts: socks5.Timeouts{
+			Handshake: cfg.Timeouts.Handshake,
+			Dial:      cfg.Timeouts.Dial,
+			IdleUp:    cfg.Timeouts.IdleUp,
+			IdleDown:  cfg.Timeouts.IdleDown,
+		},
+		Bandwidth: socks5.RateLimits{
+			Global: [2]socks5.ByteRate{cfg.Bandwidth.RateUp, cfg.Bandwidth.RateDown},
+			Client: [2]socks5.ByteRate{cfg.Bandwidth.ClientRateUp, cfg.Bandwidth.ClientRateDown},
+			User:   [2]socks5.ByteRate{cfg.Bandwidth.UserRateUp, cfg.Bandwidth.UserRateDown},
+		},
+		Limits: socks5.AdmissionLimits{
+			MaxSessions: cfg.Limits.MaxSessions,
+			MaxPerIP:    cfg.Limits.MaxPerIP,
+			Rate:        cfg.Limits.Rate,
+		},
+	}
+
+	var err error
+	srv.Authenticators, err = newAuthenticators(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.DNS.Servers) > 0 {
+		srv.Resolver, err = socks5.NewResolver(cfg.DNS.Servers, cfg.DNS.TCP, cfg.DNS.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("resolver: %v", err)
+		}
+		log.Printf("Using caching resolver with servers %v", srv.Resolver.Servers())
+	}
+
+	srv.Rules, err = newRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	direct := socks5.DirectDialer{Resolver: srv.Resolver}
+	var fallback socks5.Dialer = direct
+	if len(cfg.Upstream) > 0 {
+		fallback, err = socks5.ParseChain(cfg.Upstream, direct)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: %v", err)
+		}
+		log.Printf("Default route: %v", fallback)
+	}
+	srv.Dialer = fallback
+	if cfg.RoutesFile != "" {
+		routes, err := socks5.LoadRoutes(cfg.RoutesFile, fallback, direct)
+		if err != nil {
+			return nil, fmt.Errorf("routes: %v", err)
+		}
+		log.Printf("Loaded %d route(s) from %s, default route: %v", routes.Len(), cfg.RoutesFile, routes.Fallback())
+		srv.Dialer = routes
+	}
+
+	srv.Rewrites, err = newRewrites(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.Egress, srv.UserEgress, err = newEgress(cfg.Egress)
+	if err != nil {
+		return nil, err
+	}
+
+	if srv.Engine != socks5.EngineGoroutine && srv.Engine != socks5.EngineEpoll {
+		return nil, fmt.Errorf("unknown engine: %s", srv.Engine)
+	}
+	if srv.Engine == socks5.EngineEpoll && srv.EpollLoops < 0 {
+		return nil, fmt.Errorf("invalid number of epoll loops: %d", srv.EpollLoops)
+	}
+
+	if srv.Limits.MaxSessions < 0 || srv.Limits.MaxPerIP < 0 || srv.Limits.Rate < 0 {
+		return nil, errors.New("connection limits must not be negative")
+	}
+
+	return srv, nil
+}
+
+// listenerSpec адрес листенера и настройки принятых им сессий
+type listenerSpec struct {
+	address string
+	policy  *socks5.ListenerPolicy
+}
+
+// describe пояснение к адресу листенера для журнала
+func (spec listenerSpec) describe() string {
+	var notes []string
+	if spec.policy.Name != "" {
+		notes = append(notes, spec.policy.Name)
+	}
+	if spec.policy.TLSConfig != nil {
+		notes = append(notes, "TLS")
+	}
+	if spec.policy.Egress != nil {
+		notes = append(notes, "egress "+spec.policy.Egress.String())
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, ", ") + ")"
+}
+
+// newListeners листенеры из списка listeners, а без него - единственный из listen
+func newListeners(cfg *config) ([]listenerSpec, error) {
+	listens := cfg.Listeners
+	if len(listens) == 0 {
+		listens = []listenConfig{cfg.Listen}
+	}
+
+	specs := make([]listenerSpec, 0, len(listens))
+	for i, lc := range listens {
+		spec, err := newListener(lc)
+		if err != nil {
+			if len(cfg.Listeners) > 0 {
+				return nil, fmt.Errorf("listener %d: %v", i+1, err)
+			}
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// newListener проверка адреса листенера и загрузка его настроек TLS и исходящих адресов
+func newListener(lc listenConfig) (listenerSpec, error) {
+	parsedPort, err := strconv.Atoi(lc.Port)
+	if err != nil || parsedPort <= 0 || parsedPort > 65535 {
+		return listenerSpec{}, fmt.Errorf("invalid port number: %s", lc.Port)
+	}
+	if lc.Address != "" && net.ParseIP(lc.Address) == nil {
+		return listenerSpec{}, fmt.Errorf("invalid listen address: %s", lc.Address)
+	}
+	spec := listenerSpec{
+		address: net.JoinHostPort(lc.Address, lc.Port),
+		policy:  &socks5.ListenerPolicy{Name: lc.Name},
+	}
+
+	tlsCfg := lc.TLS
+	if (tlsCfg.Cert == "") != (tlsCfg.Key == "") {
+		return listenerSpec{}, errors.New("both TLS certificate and key must be set to enable TLS")
+	}
+	if tlsCfg.Cert == "" && (tlsCfg.ClientCA != "" || tlsCfg.RequireClientCert) {
+		return listenerSpec{}, errors.New("client certificate options require a TLS certificate and key")
+	}
+	if tlsCfg.Cert != "" {
+		spec.policy.TLSConfig, err = socks5.LoadTLSConfig(tlsCfg.Cert, tlsCfg.Key, tlsCfg.ClientCA, tlsCfg.RequireClientCert)
+		if err != nil {
+			return listenerSpec{}, fmt.Errorf("TLS: %v", err)
+		}
+	}
+
+	if len(lc.Egress) > 0 {
+		spec.policy.Egress, err = socks5.NewEgressPool(lc.Egress)
+		if err != nil {
+			return listenerSpec{}, fmt.Errorf("egress: %v", err)
+		}
+	}
+	return spec, nil
+}
+
+// newEgress общий пул исходящих адресов и пулы пользователей, nil - адрес выбирает ядро
+func newEgress(egress egressConfig) (*socks5.EgressPool, map[string]*socks5.EgressPool, error) {
+	var pool *socks5.EgressPool
+	if len(egress.Addresses) > 0 {
+		var err error
+		pool, err = socks5.NewEgressPool(egress.Addresses)
+		if err != nil {
+			return nil, nil, fmt.Errorf("egress: %v", err)
+		}
+		log.Printf("Using egress addresses %v", pool)
+	}
+
+	var users map[string]*socks5.EgressPool
+	for user, addrs := range egress.Users {
+		userPool, err := socks5.NewEgressPool(addrs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("egress of user %q: %v", user, err)
+		}
+		if users == nil {
+			users = make(map[string]*socks5.EgressPool)
+		}
+		users[user] = userPool
+	}
+	return pool, users, nil
+}
+
+// newAuthenticators методы аутентификации в порядке предпочтения сервера
+func newAuthenticators(auth authConfig) ([]socks5.Authenticator, error) {
+	users := make(socks5.Credentials)
+	if auth.File != "" {
+		fromFile, err := socks5.LoadCredentials(auth.File)
+		if err != nil {
+			return nil, fmt.Errorf("credentials: %v", err)
+		}
+		for user, hash := range fromFile {
+			users[user] = hash
+		}
+	}
+	inline, err := socks5.NewCredentials(auth.Users)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %v", err)
+	}
+	for user, hash := range inline {
+		users[user] = hash
+	}
+
+	var auths []socks5.Authenticator
+	if len(users) > 0 || auth.File != "" {
+		auths = append(auths, socks5.UserPassAuthenticator{Users: users})
+		log.Printf("Loaded %d user(s)", len(users))
+	}
+	if len(auths) == 0 || auth.AllowNoAuth {
+		auths = append(auths, socks5.NoAuthAuthenticator{})
+	}
+	return auths, nil
+}
+
+// newRules правила доступа из файла или из конфигурации, nil - разрешено всё
+func newRules(cfg *config) (*socks5.RuleSet, error) {
+	switch {
+	case cfg.RulesFile != "" && len(cfg.Rules) > 0:
+		return nil, errors.New("rules file and inline rules are mutually exclusive")
+	case cfg.RulesFile != "":
+		rules, err := socks5.LoadRules(cfg.RulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("rules: %v", err)
+		}
+		log.Printf("Loaded %d access rule(s) from %s", rules.Len(), cfg.RulesFile)
+		return rules, nil
+	case len(cfg.Rules) > 0:
+		rules, err := socks5.ParseRules(cfg.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("rules: %v", err)
+		}
+		log.Printf("Loaded %d access rule(s)", rules.Len())
+		return rules, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newRewrites таблица подмены адресов назначения из файла или из конфигурации, nil - без подмены
+func newRewrites(cfg *config) (*socks5.RewriteTable, error) {
+	switch {
+	case cfg.RewritesFile != "" && len(cfg.Rewrites) > 0:
+		return nil, errors.New("rewrites file and inline rewrites are mutually exclusive")
+	case cfg.RewritesFile != "":
+		rewrites, err := socks5.LoadRewrites(cfg.RewritesFile)
+		if err != nil {
+			return nil, fmt.Errorf("rewrites: %v", err)
+		}
+		log.Printf("Loaded %d destination rewrite(s) from %s", rewrites.Len(), cfg.RewritesFile)
+		return rewrites, nil
+	case len(cfg.Rewrites) > 0:
+		rewrites, err := socks5.ParseRewrites(cfg.Rewrites)
+		if err != nil {
+			return nil, fmt.Errorf("rewrites: %v", err)
+		}
+		log.Printf("Loaded %d destination rewrite(s)", rewrites.Len())
+		return rewrites, nil
+	default:
+		return nil, nil
+	}
+}
+
+// reload повторное чтение настроек по SIGHUP и замена пользователей и правил доступа.
+// Установленные туннели не затрагиваются; ошибочная конфигурация отклоняется целиком,
+// и продолжают действовать прежние настройки. Остальные параметры требуют перезапуска
+func reload(srv *socks5.Server, path string) {
+	log.Printf("Reloading configuration")
+
+	cfg, err := loadConfig(path, os.Args[1:])
+	if err != nil {
+		log.Printf("Error reloading configuration, keeping the previous one: %v", err)
+		return
+	}
+	next, err := newServer(cfg)
+	if err != nil {
+		log.Printf("Invalid configuration, keeping the previous one: %v", err)
+		return
+	}
+
+	srv.SetAuthenticators(next.Authenticators)
+	srv.SetRules(next.Rules)
+	log.Printf("Configuration reloaded: users and access rules updated")
+}
+
+// serveMetrics запуск HTTP-сервера с метриками по пути /metrics
+func serveMetrics(address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Printf("Metrics server stopped: %v", err)
+	}()
+	return nil
+}
+
+// serveAdmin запуск HTTP-сервера с API администрирования
+func serveAdmin(address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving admin API on http://%s/", listener.Addr().String())
+
+	// API не требует аутентификации
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		log.Printf("Warning: admin API is reachable from other hosts, restrict access to %s", listener.Addr().String())
+	}
+
+	go func() {
+		err := http.Serve(listener, handler)
+		log.Printf("Admin server stopped: %v", err)
+	}()
+	return nil
+}
@@ -0,0 +1,270 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessRecord запись журнала доступа: итог одной сессии
+type accessRecord struct {
+	Session     uint64    `json:"session"`
+	Client      string    `json:"client"`
+	Listener    string    `json:"listener,omitempty"`
+	Protocol    string    `json:"protocol"`
+	User        string    `json:"user,omitempty"`
+	Command     string    `json:"command,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Resolved    string    `json:"resolved,omitempty"` // фактический адрес удалённого узла при прямом подключении
+	Via         string    `json:"via,omitempty"`      // цепочка вышестоящих прокси
+	Reply       *byte     `json:"reply,omitempty"`    // последний код ответа в терминах SOCKS5
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+	Start       time.Time `json:"start"`
+	DurationMs  int64     `json:"duration_ms"`
+}
+
+// sessionInfo сведения о сессии, общие для обоих движков
+type sessionInfo struct {
+	id      uint64
+	started time.Time
+	reply   byte
+	replied bool
+	bytes   [2]atomic.Int64 // переданные байты по направлениям
+	policy  *ListenerPolicy // настройки листенера, принявшего соединение
+
+	// Поля ниже читает API администрирования из других горутин,
+	// поэтому сессия меняет их только под statusMu
+	statusMu    sync.Mutex
+	version     byte   // версия протокола клиента, 0 - не определена
+	user        string // имя аутентифицированного пользователя, пусто при NoAuth
+	command     byte
+	destination string // адрес из запроса "host:port"
+	resolved    string
+	via         string // цепочка вышестоящих прокси, пусто при прямом подключении
+}
+
+// begin присвоение идентификатора и отметка времени начала сессии
+func (s *sessionInfo) begin(id uint64) {
+	s.id = id
+	s.started = time.Now()
+}
+
+// setReply запоминание отправленного клиенту кода ответа
+func (s *sessionInfo) setReply(rep byte) {
+	s.reply = rep
+	s.replied = true
+}
+
+// setVersion запоминание версии протокола клиента
+func (s *sessionInfo) setVersion(version byte) {
+	s.statusMu.Lock()
+	s.version = version
+	s.statusMu.Unlock()
+}
+
+// setUser запоминание имени аутентифицированного пользователя
+func (s *sessionInfo) setUser(user string) {
+	s.statusMu.Lock()
+	s.user = user
+	s.statusMu.Unlock()
+}
+
+// setRequest запоминание команды и адреса из запроса клиента
+func (s *sessionInfo) setRequest(cmd byte, destination string) {
+	s.statusMu.Lock()
+	s.command = cmd
+	s.destination = destination
+	s.statusMu.Unlock()
+}
+
+// setRoute запоминание пути к удалённому узлу: адреса remote при прямом
+// подключении или цепочки вышестоящих прокси via, иначе remote - адрес прокси
+func (s *sessionInfo) setRoute(remote net.Addr, via string) {
+	s.statusMu.Lock()
+	if via != "" {
+		s.via = via
+	} else {
+		s.resolved = remote.String()
+	}
+	s.statusMu.Unlock()
+}
+
+// commandName название команды для журнала
+func commandName(cmd byte) string {
+	switch cmd {
+	case TCP:
+		return "connect"
+	case Bind:
+		return "bind"
+	case UDPAssociate:
+		return "udp_associate"
+	case 0:
+		return ""
+	default:
+		return fmt.Sprintf("unknown_%x", cmd)
+	}
+}
+
+// record формирование записи журнала по завершении сессии
+func (s *sessionInfo) record(client net.Addr, user string) *accessRecord {
+	rec := &accessRecord{
+		Session:     s.id,
+		Client:      client.String(),
+		Listener:    s.listenerName(),
+		Protocol:    protocolName(s.version),
+		User:        user,
+		Command:     commandName(s.command),
+		Destination: s.destination,
+		Resolved:    s.resolved,
+		Via:         s.via,
+		BytesUp:     s.bytes[directionUp].Load(),
+		BytesDown:   s.bytes[directionDown].Load(),
+		Start:       s.started,
+		DurationMs:  time.Since(s.started).Milliseconds(),
+	}
+	if s.replied {
+		rep := s.reply
+		rec.Reply = &rep
+	}
+	return rec
+}
+
+// listenerName имя листенера, принявшего соединение
+func (s *sessionInfo) listenerName() string {
+	if s.policy == nil {
+		return ""
+	}
+	return s.policy.Name
+}
+
+// protocolName название версии протокола для журнала
+func protocolName(version byte) string {
+	switch version {
+	case SocksVersion:
+		return "socks5"
+	case Socks4Version:
+		return "socks4"
+	case HTTPVersion:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// AccessLog журнал доступа в формате JSON lines с ротацией по размеру
+type AccessLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // размер, после которого файл ротируется, 0 - без ротации
+	backups int   // количество хранимых старых файлов: path.1 ... path.N
+	file    *os.File
+	size    int64
+}
+
+// OpenAccessLog открытие журнала доступа для дозаписи. maxSize - размер в байтах,
+// после которого файл ротируется (0 - без ротации), backups - количество старых файлов
+func OpenAccessLog(path string, maxSize int64, backups int) (*AccessLog, error) {
+	l := &AccessLog{path: path, maxSize: maxSize, backups: backups}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate переименование текущего файла в path.1 со сдвигом старых копий
+func (l *AccessLog) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+
+	if l.backups > 0 {
+		for i := l.backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// write запись одной строки журнала
+func (l *AccessLog) write(rec *accessRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			err = fmt.Errorf("rotating %s: %w", l.path, err)
+		}
+	}
+	// После неудачной ротации файл открывается заново
+	if l.file == nil {
+		openErr := l.open()
+		if openErr != nil {
+			return errors.Join(err, openErr)
+		}
+	}
+
+	n, werr := l.file.Write(line)
+	l.size += int64(n)
+	return errors.Join(err, werr)
+}
+
+// Close закрытие файла журнала
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// logAccess запись итога сессии в журнал доступа, если он включён
+func (s *Server) logAccess(rec *accessRecord) {
+	if s.AccessLog == nil {
+		return
+	}
+	err := s.AccessLog.write(rec)
+	if err != nil {
+		s.logf("Error writing access log: %v", err)
+	}
+}
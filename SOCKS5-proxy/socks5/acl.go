@@ -0,0 +1,399 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// errNotAllowed соединение запрещено правилами доступа
+var errNotAllowed = errors.New("connection not allowed by ruleset")
+
+// portRange диапазон портов включительно
+type portRange struct {
+	from, to int
+}
+
+// aclRule правило доступа. Пустое условие совпадает с чем угодно
+type aclRule struct {
+	allow bool
+	line  int    // номер строки в файле правил
+	text  string // исходный текст правила для журнала
+
+	clients []*net.IPNet // подсети клиентов
+	users   []string     // аутентифицированные пользователи
+	hosts   []string     // шаблоны имён назначения: точное имя, "*.domain", ".domain"
+	nets    []*net.IPNet // подсети назначения
+	ports   []portRange  // порты назначения
+
+	egress *EgressPool // исходящие адреса разрешённых подключений, nil - не заданы
+}
+
+// RuleSet упорядоченный список правил, применяется первое совпавшее
+type RuleSet struct {
+	rules []*aclRule
+}
+
+// LoadRules чтение файла правил.
+// Формат строки: "allow|deny [client=CIDR,...] [user=name,...] [dest=host|CIDR,...] [port=N|N-M,...]",
+// у allow также "[egress=IP,...]" - исходящие адреса подключений по правилу;
+// пустые строки и строки с '#' пропускаются. Доменное имя, которое не удалось
+// разрешить, попадает под запрещающие правила с подсетями dest
+func LoadRules(filename string) (*RuleSet, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rs := &RuleSet{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		rule.line = lineNum
+		rs.rules = append(rs.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// ParseRules разбор правил того же формата, что и в файле, из списка строк.
+// Номером строки правила считается его позиция в списке
+func ParseRules(lines []string) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rule.line = i + 1
+		rs.rules = append(rs.rules, rule)
+	}
+	return rs, nil
+}
+
+// Len количество правил
+func (rs *RuleSet) Len() int {
+	return len(rs.rules)
+}
+
+// parseRule разбор одного правила
+func parseRule(text string) (*aclRule, error) {
+	fields := strings.Fields(text)
+	rule := &aclRule{text: strings.Join(fields, " ")}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("expected \"allow\" or \"deny\", got %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+
+		if key == "egress" {
+			if !rule.allow {
+				return nil, errors.New("egress is only valid in allow rules")
+			}
+			pool, err := NewEgressPool(strings.Split(value, ","))
+			if err != nil {
+				return nil, err
+			}
+			rule.egress = pool
+			continue
+		}
+
+		for _, v := range strings.Split(value, ",") {
+			switch key {
+			case "client":
+				ipNet, err := parseCIDR(v)
+				if err != nil {
+					return nil, err
+				}
+				rule.clients = append(rule.clients, ipNet)
+
+			case "user":
+				rule.users = append(rule.users, v)
+
+			case "dest":
+				if strings.Contains(v, "/") || net.ParseIP(v) != nil {
+					ipNet, err := parseCIDR(v)
+					if err != nil {
+						return nil, err
+					}
+					rule.nets = append(rule.nets, ipNet)
+				} else {
+					if _, err := path.Match(v, ""); err != nil {
+						return nil, fmt.Errorf("invalid host pattern %q", v)
+					}
+					rule.hosts = append(rule.hosts, strings.ToLower(v))
+				}
+
+			case "port":
+				pr, err := parsePortRange(v)
+				if err != nil {
+					return nil, err
+				}
+				rule.ports = append(rule.ports, pr)
+
+			default:
+				return nil, fmt.Errorf("unknown condition %q", key)
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+// parseCIDR разбор подсети; одиночный IP-адрес считается подсетью из одного адреса
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address or CIDR %q", s)
+	}
+	return ipNet, nil
+}
+
+// parsePortRange разбор порта "N" или диапазона "N-M"
+func parsePortRange(s string) (portRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+
+	from, err1 := strconv.Atoi(fromStr)
+	to, err2 := strconv.Atoi(toStr)
+	if err1 != nil || err2 != nil || from < 0 || to > 65535 || from > to {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{from: from, to: to}, nil
+}
+
+// match проверка совпадения правила с запросом.
+// ips - адреса назначения (для доменного имени - результат разрешения, может быть пустым)
+func (r *aclRule) match(clientIP net.IP, user, host string, ips []net.IP, port int) bool {
+	if len(r.clients) > 0 && !containsIP(r.clients, clientIP) {
+		return false
+	}
+	if len(r.users) > 0 && !containsString(r.users, user) {
+		return false
+	}
+	if len(r.ports) > 0 && !containsPort(r.ports, port) {
+		return false
+	}
+
+	if len(r.hosts) == 0 && len(r.nets) == 0 {
+		return true
+	}
+	for _, pattern := range r.hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	if len(r.nets) == 0 {
+		return false
+	}
+	if len(ips) == 0 {
+		// Имя не разрешилось: подсети проверить нельзя, поэтому запрещающее
+		// правило срабатывает, а разрешающее - нет
+		return !r.allow
+	}
+
+	// Доменное имя может разрешаться в несколько адресов: запрещающее правило
+	// срабатывает на любой из них, разрешающее - только если в подсеть попадают все
+	for _, ip := range ips {
+		in := containsIP(r.nets, ip)
+		if in && !r.allow {
+			return true
+		}
+		if !in && r.allow {
+			return false
+		}
+	}
+	return r.allow
+}
+
+// matchHost сравнение имени назначения с шаблоном:
+// "*" и "?" - шаблон в стиле glob, ".domain" - сам домен и все поддомены, иначе точное совпадение
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	switch {
+	case strings.ContainsAny(pattern, "*?["):
+		ok, _ := path.Match(pattern, host)
+		return ok
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []portRange, port int) bool {
+	for _, pr := range ranges {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// check поиск первого совпавшего правила. Если ни одно не совпало, соединение запрещено.
+// Доменное имя разрешается, только когда очередь доходит до правила с подсетями
+// назначения; resolved - полученные при этом адреса, nil - имя не разрешалось
+func (rs *RuleSet) check(resolver *Resolver, clientIP net.IP, user, address string) (allowed bool, rule *aclRule, resolved []net.IP) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false, nil, nil
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	var ips []net.IP
+	isName := false
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		isName = true
+	}
+
+	looked := false
+	for _, rule := range rs.rules {
+		if isName && !looked && len(rule.nets) > 0 {
+			ips, _ = resolver.LookupIPs(host)
+			looked = true
+		}
+		if rule.match(clientIP, user, host, ips, port) {
+			if looked {
+				resolved = ips
+			}
+			return rule.allow, rule, resolved
+		}
+	}
+	return false, nil, nil
+}
+
+// checkedKey ключ адресов назначения, проверенных правилами доступа, в контексте подключения
+type checkedKey struct{}
+
+// checkedAddrs адреса "ip:port", в которые разрешилось имя из address при проверке доступа
+type checkedAddrs struct {
+	address string
+	addrs   []string
+}
+
+// withChecked контекст подключения к address только по адресам addrs,
+// проверенным правилами доступа, а не по повторному разрешению имени
+func withChecked(ctx context.Context, address string, addrs []string) context.Context {
+	if addrs == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, checkedKey{}, checkedAddrs{address: address, addrs: addrs})
+}
+
+// checkedFrom проверенные адреса для подключения к address, nil - не заданы.
+// Подключения к другим адресам (например, к вышестоящему прокси) их не используют
+func checkedFrom(ctx context.Context, address string) []string {
+	checked, ok := ctx.Value(checkedKey{}).(checkedAddrs)
+	if !ok || checked.address != address {
+		return nil
+	}
+	return checked.addrs
+}
+
+// checkAccess проверка запроса клиента по правилам доступа; при разрешении
+// возвращает исходящие адреса разрешившего правила (nil - не заданы) и адреса
+// "ip:port", по которым проверено доменное имя (nil - не разрешалось): подключаться
+// нужно к ним, иначе повторное разрешение может дать адрес в обход правил.
+// Запрет фиксируется в журнале вместе с совпавшим правилом
+func (s *Server) checkAccess(client net.Addr, user, address string) (*EgressPool, []string, error) {
+	rules := s.rules.Load()
+	if rules == nil {
+		return nil, nil, nil
+	}
+
+	var clientIP net.IP
+	switch a := client.(type) {
+	case *net.TCPAddr:
+		clientIP = a.IP
+	case *net.UDPAddr:
+		clientIP = a.IP
+	}
+
+	allowed, rule, resolved := rules.check(s.Resolver, clientIP, user, address)
+	if allowed {
+		var checked []string
+		if resolved != nil {
+			_, port, _ := net.SplitHostPort(address)
+			for _, ip := range resolved {
+				checked = append(checked, net.JoinHostPort(ip.String(), port))
+			}
+		}
+		return rule.egress, checked, nil
+	}
+
+	who := client.String()
+	if user != "" {
+		who = fmt.Sprintf("%s (user %q)", who, user)
+	}
+	if rule != nil {
+		s.logf("Denied %s -> %s by rule at line %d: %s", who, address, rule.line, rule.text)
+		return nil, nil, fmt.Errorf("%w (rule at line %d)", errNotAllowed, rule.line)
+	}
+	s.logf("Denied %s -> %s: no rule matched", who, address)
+	return nil, nil, fmt.Errorf("%w (no rule matched)", errNotAllowed)
+}
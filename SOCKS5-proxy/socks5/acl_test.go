@@ -0,0 +1,183 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+		check   func(r *aclRule) bool
+	}{
+		{text: "allow", check: func(r *aclRule) bool { return r.allow }},
+		{text: "deny", check: func(r *aclRule) bool { return !r.allow }},
+		{
+			text: "allow client=10.0.0.0/8,192.0.2.1 user=alice,bob",
+			check: func(r *aclRule) bool {
+				return len(r.clients) == 2 && r.clients[1].String() == "192.0.2.1/32" && len(r.users) == 2
+			},
+		},
+		{
+			text: "deny dest=127.0.0.0/8,::1,*.Example.COM,.internal",
+			check: func(r *aclRule) bool {
+				return len(r.nets) == 2 && r.nets[1].String() == "::1/128" &&
+					len(r.hosts) == 2 && r.hosts[0] == "*.example.com" && r.hosts[1] == ".internal"
+			},
+		},
+		{
+			text: "allow port=80,8000-8080",
+			check: func(r *aclRule) bool {
+				return len(r.ports) == 2 && r.ports[0] == portRange{80, 80} && r.ports[1] == portRange{8000, 8080}
+			},
+		},
+		{
+			text: "allow  dest=example.com   egress=192.0.2.7",
+			check: func(r *aclRule) bool {
+				return r.egress != nil && r.egress.String() == "192.0.2.7" && r.text == "allow dest=example.com egress=192.0.2.7"
+			},
+		},
+		{text: "permit", wantErr: true},
+		{text: "allow dest", wantErr: true},
+		{text: "allow dest=", wantErr: true},
+		{text: "allow client=example.com", wantErr: true},
+		{text: "allow dest=10.0.0.0/33", wantErr: true},
+		{text: "allow dest=[bad", wantErr: true},
+		{text: "allow port=80-70", wantErr: true},
+		{text: "allow port=65536", wantErr: true},
+		{text: "allow port=http", wantErr: true},
+		{text: "allow color=red", wantErr: true},
+		{text: "deny egress=192.0.2.7", wantErr: true},
+		{text: "allow egress=not-an-ip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseRule(tt.text)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRule(%q) succeeded, want error", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRule(%q): %v", tt.text, err)
+			continue
+		}
+		if !tt.check(rule) {
+			t.Errorf("parseRule(%q) = %+v", tt.text, rule)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", true}, // "*" захватывает и точки
+		{"host?.test", "host1.test", true},
+		{".example.com", "example.com", true},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"example.com", "", false},
+		{".example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRuleSetCheck(t *testing.T) {
+	// internal.test разрешается в loopback, public.test и www.example.com - в адреса
+	// из документации, mixed.test - в оба, остальные имена не существуют
+	stub := newStubDNS(t, func(q dnsmessage.Question, tcp bool) stubAnswer {
+		switch q.Name.String() {
+		case "internal.test.":
+			return stubAnswer{ips: []net.IP{net.IPv4(127, 0, 0, 1)}, ttl: 60}
+		case "public.test.", "www.example.com.":
+			return stubAnswer{ips: []net.IP{net.IPv4(192, 0, 2, 10)}, ttl: 60}
+		case "mixed.test.":
+			return stubAnswer{ips: []net.IP{net.IPv4(192, 0, 2, 10), net.IPv4(127, 0, 0, 2)}, ttl: 60}
+		}
+		return stubAnswer{nxdomain: true, soaTTL: 60, soaMin: 60}
+	})
+	resolver := newTestResolver(t, stub.addr)
+
+	rs, err := ParseRules([]string{
+		"deny client=203.0.113.0/24",
+		"allow user=admin",
+		"deny dest=127.0.0.0/8,::1",
+		"allow dest=.example.com port=443",
+		"deny dest=*.example.com",
+		"allow dest=192.0.2.0/24",
+		"allow port=80",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := net.IPv4(198, 51, 100, 1)
+	tests := []struct {
+		name     string
+		client   net.IP
+		user     string
+		address  string
+		allowed  bool
+		line     int // номер совпавшего правила, 0 - ни одно не совпало
+		resolved bool
+	}{
+		{"client subnet", net.IPv4(203, 0, 113, 5), "admin", "192.0.2.1:22", false, 1, false},
+		{"user before dest", client, "admin", "127.0.0.1:22", true, 2, false},
+		{"loopback address", client, "", "127.0.0.1:80", false, 3, false},
+		{"loopback IPv6", client, "", "[::1]:80", false, 3, false},
+		{"name resolving to loopback", client, "", "internal.test:80", false, 3, true},
+		{"any address of a name", client, "", "mixed.test:80", false, 3, true},
+		{"unresolvable name fails closed", client, "", "missing.test:80", false, 3, true},
+		{"empty host", client, "", ":80", false, 0, false},
+		{"malformed address", client, "", "example.com", false, 0, false},
+		{"domain and port", client, "", "www.example.com:443", true, 4, true},
+		{"domain without port", client, "", "www.example.com:80", false, 5, true},
+		{"allowed subnet", client, "", "public.test:22", true, 6, true},
+		{"allowed port", client, "", "203.0.113.9:80", true, 7, false},
+		{"no rule matched", client, "", "203.0.113.9:22", false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, rule, resolved := rs.check(resolver, tt.client, tt.user, tt.address)
+			line := 0
+			if rule != nil {
+				line = rule.line
+			}
+			if allowed != tt.allowed || line != tt.line {
+				t.Fatalf("check(%s) = %v by rule %d, want %v by rule %d", tt.address, allowed, line, tt.allowed, tt.line)
+			}
+			if allowed && tt.resolved != (resolved != nil) {
+				t.Fatalf("check(%s) resolved %v, want resolved=%v", tt.address, resolved, tt.resolved)
+			}
+		})
+	}
+}
+
+func TestParseAddrRejectsEmptyDomain(t *testing.T) {
+	_, _, err := parseAddr([]byte{DomainName, 0, 0, 80})
+	if err != errEmptyDomain {
+		t.Fatalf("got error %v, want %v", err, errEmptyDomain)
+	}
+
+	address, n, err := parseAddr([]byte{DomainName, 1, 'a', 0, 80, 0xff})
+	if err != nil || address != "a:80" || n != 5 {
+		t.Fatalf("got %q, %d, %v, want \"a:80\", 5, nil", address, n, err)
+	}
+}
@@ -0,0 +1,223 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SessionStatus состояние активной сессии
+type SessionStatus struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	Listener    string    `json:"listener,omitempty"`
+	Protocol    string    `json:"protocol"`
+	User        string    `json:"user,omitempty"`
+	Command     string    `json:"command,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Resolved    string    `json:"resolved,omitempty"`
+	Via         string    `json:"via,omitempty"`
+	Start       time.Time `json:"start"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+}
+
+// ServerStatus сводное состояние прокси
+type ServerStatus struct {
+	Started        time.Time      `json:"started"`
+	UptimeSeconds  float64        `json:"uptime_seconds"`
+	Engine         string         `json:"engine"`
+	ActiveSessions int            `json:"active_sessions"`
+	TotalSessions  uint64         `json:"total_sessions"`
+	ActiveClients  int            `json:"active_clients"` // различные IP-адреса клиентов
+	Protocols      map[string]int `json:"protocols"`      // активные сессии по протоколам
+	RelayedUp      uint64         `json:"relayed_bytes_up"`
+	RelayedDown    uint64         `json:"relayed_bytes_down"`
+}
+
+// status снимок сведений о сессии клиента client
+func (s *sessionInfo) status(client net.Addr) SessionStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	return SessionStatus{
+		ID:          s.id,
+		Client:      client.String(),
+		Listener:    s.listenerName(),
+		Protocol:    protocolName(s.version),
+		User:        s.user,
+		Command:     commandName(s.command),
+		Destination: s.destination,
+		Resolved:    s.resolved,
+		Via:         s.via,
+		Start:       s.started,
+		AgeSeconds:  time.Since(s.started).Seconds(),
+		BytesUp:     s.bytes[directionUp].Load(),
+		BytesDown:   s.bytes[directionDown].Load(),
+	}
+}
+
+func (s *session) status() SessionStatus { return s.sessionInfo.status(s.conn.RemoteAddr()) }
+
+// Sessions активные сессии в порядке их начала
+func (s *Server) Sessions() []SessionStatus {
+	s.setupOnce.Do(s.setup)
+
+	sessions := s.registry.list()
+	statuses := make([]SessionStatus, 0, len(sessions))
+	for _, sess := range sessions {
+		statuses = append(statuses, sess.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// CloseSession принудительное закрытие сессии с идентификатором id.
+// Возвращает false, если такой активной сессии нет
+func (s *Server) CloseSession(id uint64) bool {
+	s.setupOnce.Do(s.setup)
+
+	for _, sess := range s.registry.list() {
+		if sess.status().ID == id {
+			sess.forceClose()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseClient принудительное закрытие всех сессий клиента с адресом ip.
+// Возвращает количество закрытых сессий
+func (s *Server) CloseClient(ip net.IP) int {
+	s.setupOnce.Do(s.setup)
+
+	closed := 0
+	for _, sess := range s.registry.list() {
+		if clientIP(sess.status().Client).Equal(ip) {
+			sess.forceClose()
+			closed++
+		}
+	}
+	return closed
+}
+
+// Status сводное состояние прокси
+func (s *Server) Status() ServerStatus {
+	s.setupOnce.Do(s.setup)
+
+	active, total := s.registry.count()
+	status := ServerStatus{
+		Started:        s.started,
+		UptimeSeconds:  time.Since(s.started).Seconds(),
+		Engine:         s.Engine,
+		ActiveSessions: active,
+		TotalSessions:  total,
+		Protocols:      make(map[string]int),
+		RelayedUp:      s.metrics.bytes[directionUp].Load(),
+		RelayedDown:    s.metrics.bytes[directionDown].Load(),
+	}
+	if status.Engine == "" {
+		status.Engine = EngineGoroutine
+	}
+
+	clients := make(map[string]struct{})
+	for _, sess := range s.Sessions() {
+		status.Protocols[sess.Protocol]++
+		clients[clientIP(sess.Client).String()] = struct{}{}
+	}
+	status.ActiveClients = len(clients)
+	return status
+}
+
+// clientIP IP-адрес из строки "host:port"
+func clientIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// AdminHandler HTTP API администрирования. Аутентификации нет, поэтому
+// его следует делать доступным только с доверенных адресов:
+//
+//	GET    /status                 сводное состояние
+//	GET    /sessions[?client=IP]   активные сессии
+//	DELETE /sessions/{id}          закрытие сессии
+//	DELETE /clients/{ip}/sessions  закрытие всех сессий клиента
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Status())
+	})
+
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions := s.Sessions()
+		if filter := r.URL.Query().Get("client"); filter != "" {
+			ip := net.ParseIP(filter)
+			if ip == nil {
+				writeJSON(w, http.StatusBadRequest, adminError{"invalid client address"})
+				return
+			}
+			matched := sessions[:0]
+			for _, sess := range sessions {
+				if clientIP(sess.Client).Equal(ip) {
+					matched = append(matched, sess)
+				}
+			}
+			sessions = matched
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	})
+
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid session id"})
+			return
+		}
+		if !s.CloseSession(id) {
+			writeJSON(w, http.StatusNotFound, adminError{"no such session"})
+			return
+		}
+		s.logf("Closed session %d by admin request from %s", id, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, adminClosed{Closed: 1})
+	})
+
+	mux.HandleFunc("DELETE /clients/{ip}/sessions", func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid client address"})
+			return
+		}
+		closed := s.CloseClient(ip)
+		s.logf("Closed %d session(s) of client %s by admin request from %s", closed, ip, r.RemoteAddr)
+		writeJSON(w, http.StatusOK, adminClosed{Closed: closed})
+	})
+
+	return mux
+}
+
+// adminError ответ API администрирования с ошибкой
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminClosed ответ API администрирования на закрытие сессий
+type adminClosed struct {
+	Closed int `json:"closed"`
+}
+
+// writeJSON отправка ответа в формате JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,232 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	rejectTimeout    = 5 * time.Second // время на ответ отклонённому клиенту
+	maxRejectWorkers = 64              // одновременных ответов отклонённым клиентам
+)
+
+// Причины отказа в приёме соединения
+const (
+	rejectMaxSessions = "max_sessions"        // достигнут общий предел сессий
+	rejectMaxPerIP    = "max_sessions_per_ip" // достигнут предел сессий с одного IP
+	rejectRate        = "rate"                // превышена частота новых соединений
+)
+
+// AdmissionLimits ограничения на приём соединений, 0 - без ограничения
+type AdmissionLimits struct {
+	MaxSessions int     // одновременных сессий всего
+	MaxPerIP    int     // одновременных сессий с одного IP-адреса
+	Rate        float64 // новых соединений в секунду
+}
+
+// admissionControl учёт принятых сессий для проверки ограничений
+type admissionControl struct {
+	limits AdmissionLimits
+
+	mu     sync.Mutex
+	active int
+	perIP  map[string]int
+	bucket *tokenBucket // частота новых соединений, nil - без ограничения
+
+	rejecting chan struct{} // занятые обработчики отказов
+}
+
+func newAdmissionControl(limits AdmissionLimits) *admissionControl {
+	a := &admissionControl{
+		limits:    limits,
+		perIP:     make(map[string]int),
+		rejecting: make(chan struct{}, maxRejectWorkers),
+	}
+	if limits.Rate > 0 {
+		burst := max(limits.Rate, 1)
+		a.bucket = &tokenBucket{rate: limits.Rate, burst: burst, tokens: burst, last: time.Now()}
+	}
+	return a
+}
+
+// clientHost IP-адрес клиента без порта
+func clientHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit проверка ограничений для нового соединения.
+// Возвращает причину отказа или пустую строку, если соединение принято
+func (a *admissionControl) admit(remote net.Addr) string {
+	host := clientHost(remote)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case a.limits.MaxSessions > 0 && a.active >= a.limits.MaxSessions:
+		return rejectMaxSessions
+	case a.limits.MaxPerIP > 0 && a.perIP[host] >= a.limits.MaxPerIP:
+		return rejectMaxPerIP
+	case a.bucket != nil && !a.bucket.allow(1):
+		return rejectRate
+	}
+
+	a.active++
+	a.perIP[host]++
+	return ""
+}
+
+// release учёт завершения принятой сессии
+func (a *admissionControl) release(remote net.Addr) {
+	host := clientHost(remote)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.active--
+	a.perIP[host]--
+	if a.perIP[host] <= 0 {
+		delete(a.perIP, host)
+	}
+}
+
+// admit проверка нового соединения. Отклонённому клиенту отправляется
+// отказ по его протоколу, после чего соединение закрывается
+func (s *Server) admit(conn net.Conn) bool {
+	a := s.admission
+	reason := a.admit(conn.RemoteAddr())
+	if reason == "" {
+		return true
+	}
+
+	s.logf("Rejecting connection from %s: %s", conn.RemoteAddr().String(), reason)
+	s.metrics.admissionRejected(reason)
+
+	// Число одновременных ответов ограничено, остальные соединения просто закрываются
+	select {
+	case a.rejecting <- struct{}{}:
+		go func() {
+			defer func() { <-a.rejecting }()
+			s.rejectClient(conn)
+		}()
+	default:
+		conn.Close()
+	}
+	return false
+}
+
+// rejectClient отказ клиенту по протоколу, определённому по первому байту,
+// как при рукопожатии. Запрос дочитывается полностью, чтобы закрытие
+// соединения не сбросило ответ
+func (s *Server) rejectClient(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	first := make([]byte, 1)
+	_, err := io.ReadFull(conn, first)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case first[0] == SocksVersion:
+		s.rejectSOCKS5(conn)
+	case first[0] == Socks4Version:
+		_, _, _, err = readSOCKS4(conn)
+		if err != nil {
+			return
+		}
+		s.metrics.replySent(Failed)
+		_, _ = conn.Write(socks4Reply(Failed, nil))
+	case isHTTPStart(first[0]):
+		_, err = readHTTPHead(conn, first[0])
+		if err != nil {
+			return
+		}
+		s.metrics.replySent(Failed)
+		_, _ = conn.Write(httpResponse(http.StatusServiceUnavailable))
+	}
+}
+
+// rejectSOCKS5 отказ клиенту SOCKS5 без проверки учётных данных: при возможности
+// приветствие принимается без аутентификации и на запрос отправляется
+// общий отказ, иначе отклоняется аутентификация по имени и паролю
+func (s *Server) rejectSOCKS5(conn net.Conn) {
+	buf := make([]byte, 2+255)
+	_, err := io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return
+	}
+	methods := buf[1 : 1+int(buf[0])]
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case containsByte(methods, NoAuth):
+		_, err = conn.Write([]byte{SocksVersion, NoAuth})
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(conn, buf[:5])
+		if err != nil {
+			return
+		}
+		var rest int
+		switch buf[3] {
+		case IPv4:
+			rest = net.IPv4len - 1 + 2
+		case IPv6:
+			rest = net.IPv6len - 1 + 2
+		case DomainName:
+			rest = int(buf[4]) + 2
+		}
+		_, err = io.ReadFull(conn, buf[:rest])
+		if err != nil {
+			return
+		}
+		s.metrics.replySent(Failed)
+		_, _ = conn.Write(replyBytes(Failed, nil))
+
+	case containsByte(methods, UserPass):
+		_, err = conn.Write([]byte{SocksVersion, UserPass})
+		if err != nil {
+			return
+		}
+		// Учётные данные дочитываются, но не проверяются
+		_, err = io.ReadFull(conn, buf[:2]) // VER, ULEN
+		if err != nil {
+			return
+		}
+		ulen := int(buf[1])
+		_, err = io.ReadFull(conn, buf[:ulen+1]) // UNAME, PLEN
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(conn, buf[:buf[ulen]]) // PASSWD
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{UserPassVersion, UserPassFailure})
+
+	default:
+		_, _ = conn.Write([]byte{SocksVersion, NoAcceptableAuth})
+	}
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, v := range list {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	UserPassVersion = 0x01 // версия под-согласования RFC 1929
+
+	UserPassSuccess = 0x00
+	UserPassFailure = 0x01
+)
+
+// Authenticator метод аутентификации SOCKS5
+type Authenticator interface {
+	// Method код метода, передаваемый клиенту в ответе на приветствие
+	Method() byte
+	// Authenticate под-согласование после выбора метода.
+	// Возвращает имя пользователя (пустое, если метод его не предполагает)
+	Authenticate(conn net.Conn) (string, error)
+}
+
+// defaultAuthenticators методы сервера, не настроившего аутентификацию
+var defaultAuthenticators = []Authenticator{NoAuthAuthenticator{}}
+
+// authenticators методы сервера в порядке предпочтения
+func (s *Server) authenticators() []Authenticator {
+	auths := *s.auths.Load()
+	if len(auths) == 0 {
+		return defaultAuthenticators
+	}
+	return auths
+}
+
+// selectAuthenticator выбор наиболее предпочтительного для сервера метода
+// среди предложенных клиентом, nil - подходящего метода нет
+func (s *Server) selectAuthenticator(methods []byte) Authenticator {
+	for _, auth := range s.authenticators() {
+		if bytes.IndexByte(methods, auth.Method()) >= 0 {
+			return auth
+		}
+	}
+	return nil
+}
+
+// selectSessionAuthenticator выбор метода для сессии: клиенту, личность которого
+// подтверждена сертификатом TLS, достаточно метода без аутентификации
+func (s *Server) selectSessionAuthenticator(sess *session, methods []byte) Authenticator {
+	if sess.identity != "" && bytes.IndexByte(methods, NoAuth) >= 0 {
+		return NoAuthAuthenticator{}
+	}
+	return s.selectAuthenticator(methods)
+}
+
+// NoAuthAuthenticator метод без аутентификации
+type NoAuthAuthenticator struct{}
+
+func (NoAuthAuthenticator) Method() byte { return NoAuth }
+
+func (NoAuthAuthenticator) Authenticate(net.Conn) (string, error) { return "", nil }
+
+// UserPassAuthenticator аутентификация по имени пользователя и паролю (RFC 1929)
+type UserPassAuthenticator struct {
+	Users Credentials
+}
+
+func (UserPassAuthenticator) Method() byte { return UserPass }
+
+func (a UserPassAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	return userPassAuth(conn, a.Users)
+}
+
+// Credentials таблица пользователей: имя -> bcrypt-хэш пароля
+type Credentials map[string][]byte
+
+// LoadCredentials чтение файла с учётными данными.
+// Формат строки: "user:bcrypt-hash", пустые строки и строки с '#' пропускаются
+func LoadCredentials(path string) (Credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	creds := make(Credentials)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"user:bcrypt-hash\"", path, lineNum)
+		}
+		if err := checkCredential(user, hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		creds[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// NewCredentials таблица пользователей из пар имя -> bcrypt-хэш пароля
+func NewCredentials(users map[string]string) (Credentials, error) {
+	creds := make(Credentials, len(users))
+	for user, hash := range users {
+		if user == "" {
+			return nil, errors.New("empty user name")
+		}
+		if err := checkCredential(user, hash); err != nil {
+			return nil, err
+		}
+		creds[user] = []byte(hash)
+	}
+	return creds, nil
+}
+
+// checkCredential проверка имени пользователя и формата хэша
+func checkCredential(user, hash string) error {
+	if len(user) > 255 {
+		return fmt.Errorf("user name %q is longer than 255 bytes", user)
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("invalid bcrypt hash for %q: %v", user, err)
+	}
+	return nil
+}
+
+// dummyHash хэш для проверки пароля неизвестного пользователя, создаётся при первой надобности
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Verify проверка пары имя/пароль. Для неизвестного пользователя пароль
+// сравнивается с заглушкой, чтобы по времени ответа нельзя было подобрать имена
+func (c Credentials) Verify(user, password string) bool {
+	hash, ok := c[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// userPassAuth под-согласование по имени пользователя и паролю (RFC 1929).
+// Возвращает имя пользователя при успешной аутентификации
+func userPassAuth(conn net.Conn, creds Credentials) (string, error) {
+	/*
+		+----+------+----------+------+----------+
+		|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+		+----+------+----------+------+----------+
+		| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+		+----+------+----------+------+----------+
+	*/
+
+	buf := make([]byte, 2) // версия под-согласования и длина имени
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return "", err
+	}
+
+	if buf[0] != UserPassVersion {
+		return "", fmt.Errorf("unsupported username/password auth version: %x", buf[0])
+	}
+
+	user := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.ReadFull(conn, buf[:1]) // длина пароля
+	if err != nil {
+		return "", err
+	}
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return "", err
+	}
+
+	if !creds.Verify(string(user), string(password)) {
+		_, _ = conn.Write([]byte{UserPassVersion, UserPassFailure})
+		return "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+
+	_, err = conn.Write([]byte{UserPassVersion, UserPassSuccess})
+	if err != nil {
+		return "", err
+	}
+
+	return string(user), nil
+}
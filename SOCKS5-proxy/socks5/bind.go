@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+const bindAcceptTimeout = 2 * time.Minute // время ожидания входящего соединения для BIND
+
+// bindRemote обработка команды BIND: открытие слушающего сокета и ожидание
+// единственного входящего соединения от узла, указанного в запросе
+func (s *Server) bindRemote(sess *session, address string) net.Conn {
+	conn := sess.conn
+
+	// DST.ADDR - адрес узла, от которого ожидается соединение.
+	// Если это конкретный IP, соединения с других адресов отклоняются
+	host, _, _ := net.SplitHostPort(address)
+	expectedIP := net.ParseIP(host)
+	if expectedIP != nil && expectedIP.IsUnspecified() {
+		expectedIP = nil
+	}
+
+	// Адрес для удалённого узла известен только для клиентов, подключившихся по TCP
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		s.logf("BIND is not supported over %s connections", conn.LocalAddr().Network())
+		connectedSend(sess, NotSupportedCommand)
+		return nil
+	}
+
+	// Правила доступа проверяются по узлу, от которого ожидается соединение
+	ruleEgress, _, err := s.checkAccess(conn.RemoteAddr(), sess.user, address)
+	if err != nil {
+		connectedSend(sess, dialErrorReply(err))
+		return nil
+	}
+
+	// При заданном пуле исходящих адресов слушаем на адресе из пула,
+	// иначе на всех интерфейсах
+	var laddr *net.TCPAddr
+	if egress := s.egressFor(ruleEgress, sess.policy, sess.user); egress != nil {
+		ip := egress.pick(address)
+		if ip == nil {
+			s.logf("Error opening BIND listener for %s: no egress address for %s", conn.RemoteAddr().String(), address)
+			connectedSend(sess, Failed)
+			return nil
+		}
+		laddr = &net.TCPAddr{IP: ip}
+	}
+
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		s.logf("Error opening BIND listener for %s: %v", conn.RemoteAddr().String(), err)
+		connectedSend(sess, Failed)
+		return nil
+	}
+	defer listener.Close()
+	sess.track(listener)
+
+	// Первый ответ: адрес, на который удалённый узел должен подключиться
+	bndAddr := &net.TCPAddr{
+		IP:   localAddr.IP,
+		Port: listener.Addr().(*net.TCPAddr).Port,
+	}
+	if laddr != nil {
+		bndAddr.IP = laddr.IP
+	}
+	sendReply(sess, Succeeded, bndAddr)
+	s.logf("BIND listening on %s for %s, expecting %s", bndAddr.String(), conn.RemoteAddr().String(), address)
+
+	err = listener.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	if err != nil {
+		s.logf("Error setting deadline on %s: %v", bndAddr.String(), err)
+		connectedSend(sess, Failed)
+		return nil
+	}
+
+	for {
+		peerConn, err := listener.AcceptTCP()
+		if err != nil {
+			s.logf("Error accepting BIND connection on %s: %v", bndAddr.String(), err)
+			connectedSend(sess, Failed)
+			return nil
+		}
+
+		peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+		if expectedIP != nil && !peerAddr.IP.Equal(expectedIP) {
+			s.logf("Rejecting BIND connection from %s, expected %s", peerAddr.String(), expectedIP.String())
+			peerConn.Close()
+			continue
+		}
+
+		sess.track(peerConn)
+		sess.setRoute(peerAddr, "")
+
+		// Второй ответ: адрес подключившегося узла
+		sendReply(sess, Succeeded, peerAddr)
+		s.logf("BIND connection from %s relayed to %s", peerAddr.String(), conn.RemoteAddr().String())
+		return peerConn
+	}
+}
@@ -0,0 +1,278 @@
+// Package client подключение к узлам через SOCKS5-прокси (RFC 1928, RFC 1929).
+//
+// Dialer подходит для http.Transport:
+//
+//	d := &client.Dialer{ProxyAddress: "127.0.0.1:1080"}
+//	transport := &http.Transport{DialContext: d.DialContext}
+//
+// К прокси за TLS подключается Forward, например &tls.Dialer{Config: config}
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion = 0x05
+	cmdConnect   = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	methodNoAuth   = 0x00
+	methodUserPass = 0x02
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+)
+
+// Ошибки согласования с прокси
+var (
+	ErrNoAcceptableAuth = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed       = errors.New("socks5: authentication failed")
+	ErrNotSOCKS5        = errors.New("socks5: proxy is not a SOCKS5 server")
+)
+
+// ReplyError отказ прокси в выполнении запроса с кодом ответа REP
+type ReplyError struct {
+	Code byte
+}
+
+// Отказы прокси по кодам ответа, сравниваются через errors.Is
+var (
+	ErrGeneralFailure          = &ReplyError{Code: 0x01}
+	ErrNotAllowed              = &ReplyError{Code: 0x02}
+	ErrNetworkUnreachable      = &ReplyError{Code: 0x03}
+	ErrHostUnreachable         = &ReplyError{Code: 0x04}
+	ErrConnectionRefused       = &ReplyError{Code: 0x05}
+	ErrTTLExpired              = &ReplyError{Code: 0x06}
+	ErrCommandNotSupported     = &ReplyError{Code: 0x07}
+	ErrAddressTypeNotSupported = &ReplyError{Code: 0x08}
+)
+
+// replyMessages описания кодов ответа
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func (e *ReplyError) Error() string {
+	if msg, ok := replyMessages[e.Code]; ok {
+		return "socks5: " + msg
+	}
+	return fmt.Sprintf("socks5: unassigned reply code %#02x", e.Code)
+}
+
+// Is совпадение с другой ошибкой ответа по коду
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	return ok && t.Code == e.Code
+}
+
+// ContextDialer подключение к адресу с учётом контекста, подходит *net.Dialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dialer подключение к узлам через SOCKS5-прокси командой CONNECT
+type Dialer struct {
+	// ProxyAddress адрес прокси "host:port"
+	ProxyAddress string
+	// Username имя пользователя для аутентификации по паролю, пустое - без аутентификации
+	Username string
+	Password string
+	// Forward подключение к самому прокси, nil - напрямую
+	Forward ContextDialer
+}
+
+// Dial подключение к address через прокси
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext подключение к address через прокси. Срок и отмена ctx
+// действуют и на согласование с прокси. Поддерживаются сети tcp, tcp4 и tcp6
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	addr, err := encodeAddress(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, network, d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.handshakeContext(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshakeContext согласование с прокси с прерыванием по ctx
+func (d *Dialer) handshakeContext(ctx context.Context, conn net.Conn, addr []byte) error {
+	// Отмена или истечение срока ctx прерывают ожидающие чтение и запись;
+	// срок не переносится в дедлайн соединения, иначе вместо ошибки ctx
+	// вызывающий мог бы получить тайм-аут чтения
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := d.handshake(conn, addr)
+	if !stop() {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// handshake выбор метода, аутентификация и запрос CONNECT
+func (d *Dialer) handshake(conn net.Conn, addr []byte) error {
+	methods := []byte{methodNoAuth}
+	if d.Username != "" {
+		methods = append(methods, methodUserPass)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return ErrNotSOCKS5
+	}
+
+	switch buf[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if d.Username == "" {
+			return ErrNoAcceptableAuth
+		}
+		err = d.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrNoAcceptableAuth
+	}
+
+	_, err = conn.Write(append([]byte{socksVersion, cmdConnect, 0x00}, addr...))
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return ErrNotSOCKS5
+	}
+	if reply[1] != 0x00 {
+		return &ReplyError{Code: reply[1]}
+	}
+
+	// Пропускаем BND.ADDR и BND.PORT
+	var skip int
+	switch reply[3] {
+	case atypIPv4:
+		skip = net.IPv4len + 2
+	case atypIPv6:
+		skip = net.IPv6len + 2
+	case atypDomain:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return err
+		}
+		skip = int(buf[0]) + 2
+	default:
+		return fmt.Errorf("socks5: unknown address type %#02x in reply", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
+
+// authenticate под-согласование по имени пользователя и паролю (RFC 1929)
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: username or password is longer than 255 bytes")
+	}
+	msg := []byte{userPassVersion, byte(len(d.Username))}
+	msg = append(msg, d.Username...)
+	msg = append(msg, byte(len(d.Password)))
+	msg = append(msg, d.Password...)
+	_, err := conn.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[1] != userPassSuccess {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// encodeAddress кодирование "host:port" в виде ATYP, ADDR, PORT
+func encodeAddress(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+
+	var buf []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid domain name length: %q", host)
+		}
+		buf = append([]byte{atypDomain, byte(len(host))}, host...)
+	case ip.To4() != nil:
+		buf = append([]byte{atypIPv4}, ip.To4()...)
+	default:
+		buf = append([]byte{atypIPv6}, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
@@ -0,0 +1,344 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"SOCKS5-proxy/socks5"
+	"SOCKS5-proxy/socks5/client"
+)
+
+// startProxy запуск srv на случайном порту 127.0.0.1, возвращает адрес прокси
+func startProxy(t *testing.T, srv *socks5.Server) string {
+	t.Helper()
+
+	srv.Logger = log.New(io.Discard, "", 0)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return listener.Addr().String()
+}
+
+// startEchoTarget целевой сервер, возвращающий всё принятое
+func startEchoTarget(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// closedPort адрес на 127.0.0.1, подключение к которому отклоняется
+func closedPort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+// expectEcho проверка туннеля: отправленное возвращается целевым сервером
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("echoed %q (%v), want %q", buf, err, "ping")
+	}
+}
+
+func TestDialNoAuth(t *testing.T) {
+	target := startEchoTarget(t)
+	proxy := startProxy(t, &socks5.Server{})
+
+	d := &client.Dialer{ProxyAddress: proxy}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+func TestDialUserPass(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := socks5.NewCredentials(map[string]string{"alice": string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := startEchoTarget(t)
+	proxy := startProxy(t, &socks5.Server{
+		Authenticators: []socks5.Authenticator{socks5.UserPassAuthenticator{Users: users}},
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		d := &client.Dialer{ProxyAddress: proxy, Username: "alice", Password: "secret"}
+		conn, err := d.Dial("tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectEcho(t, conn)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		d := &client.Dialer{ProxyAddress: proxy, Username: "alice", Password: "wrong"}
+		_, err := d.Dial("tcp", target)
+		if !errors.Is(err, client.ErrAuthFailed) {
+			t.Fatalf("got error %v, want %v", err, client.ErrAuthFailed)
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		d := &client.Dialer{ProxyAddress: proxy}
+		_, err := d.Dial("tcp", target)
+		if !errors.Is(err, client.ErrNoAcceptableAuth) {
+			t.Fatalf("got error %v, want %v", err, client.ErrNoAcceptableAuth)
+		}
+	})
+}
+
+func TestDialReplyErrors(t *testing.T) {
+	rules, err := socks5.ParseRules([]string{"deny port=1", "allow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := startProxy(t, &socks5.Server{Rules: rules})
+	d := &client.Dialer{ProxyAddress: proxy}
+
+	_, err = d.Dial("tcp", closedPort(t))
+	if !errors.Is(err, client.ErrConnectionRefused) {
+		t.Fatalf("closed port: got error %v, want %v", err, client.ErrConnectionRefused)
+	}
+	var replyErr *client.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != 0x05 {
+		t.Fatalf("closed port: got error %#v, want *ReplyError with code 0x05", err)
+	}
+
+	_, err = d.Dial("tcp", "127.0.0.1:1")
+	if !errors.Is(err, client.ErrNotAllowed) || errors.Is(err, client.ErrConnectionRefused) {
+		t.Fatalf("denied port: got error %v, want only %v", err, client.ErrNotAllowed)
+	}
+}
+
+func TestReplyErrorIs(t *testing.T) {
+	tests := []struct {
+		err    error
+		target error
+		want   bool
+	}{
+		{&client.ReplyError{Code: 0x05}, client.ErrConnectionRefused, true},
+		{&client.ReplyError{Code: 0x04}, client.ErrConnectionRefused, false},
+		{&client.ReplyError{Code: 0x02}, client.ErrNotAllowed, true},
+		{&client.ReplyError{Code: 0x09}, client.ErrGeneralFailure, false},
+		{&client.ReplyError{Code: 0x01}, client.ErrAuthFailed, false},
+		{&client.ReplyError{Code: 0x01}, errors.New("socks5: general SOCKS server failure"), false},
+	}
+
+	for _, tt := range tests {
+		if got := errors.Is(tt.err, tt.target); got != tt.want {
+			t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+		}
+	}
+
+	if msg := (&client.ReplyError{Code: 0x09}).Error(); msg != "socks5: unassigned reply code 0x09" {
+		t.Errorf("unassigned code message %q", msg)
+	}
+}
+
+// stubProxy прокси без аутентификации, передающий в requests запрос CONNECT
+// после VER, CMD и RSV и отвечающий кодом rep
+func stubProxy(t *testing.T, rep byte) (string, <-chan []byte) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+				greeting := make([]byte, 3)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+					return
+				}
+				header := make([]byte, 5) // VER, CMD, RSV, ATYP и первый байт адреса
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				rest := map[byte]int{0x01: net.IPv4len - 1, 0x04: net.IPv6len - 1, 0x03: int(header[4])}[header[3]] + 2
+				tail := make([]byte, rest)
+				if _, err := io.ReadFull(conn, tail); err != nil {
+					return
+				}
+				requests <- append(header[3:], tail...)
+				_, _ = conn.Write([]byte{0x05, rep, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+			}()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func TestDialAddressEncoding(t *testing.T) {
+	proxy, requests := stubProxy(t, 0x00)
+	d := &client.Dialer{ProxyAddress: proxy}
+
+	tests := []struct {
+		address string
+		want    []byte
+	}{
+		{"192.0.2.1:80", []byte{0x01, 192, 0, 2, 1, 0, 80}},
+		{"[2001:db8::1]:443", []byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb}},
+		{"[::ffff:192.0.2.1]:80", []byte{0x01, 192, 0, 2, 1, 0, 80}},
+		{"example.com:8080", append(append([]byte{0x03, 11}, "example.com"...), 0x1f, 0x90)},
+	}
+	for _, tt := range tests {
+		conn, err := d.Dial("tcp", tt.address)
+		if err != nil {
+			t.Fatalf("Dial(%s): %v", tt.address, err)
+		}
+		conn.Close()
+		if got := <-requests; !bytes.Equal(got, tt.want) {
+			t.Errorf("Dial(%s) sent %x, want %x", tt.address, got, tt.want)
+		}
+	}
+
+	// Адреса, которые нельзя передать прокси, отклоняются до подключения к нему
+	for _, address := range []string{
+		":80",
+		"example.com",
+		"example.com:http",
+		"example.com:65536",
+		string(bytes.Repeat([]byte("a"), 256)) + ":80",
+	} {
+		if _, err := d.Dial("tcp", address); err == nil {
+			t.Errorf("Dial(%q) succeeded, want error", address)
+		}
+	}
+	select {
+	case got := <-requests:
+		t.Fatalf("invalid address reached the proxy as %x", got)
+	default:
+	}
+
+	if _, err := d.Dial("udp", "192.0.2.1:53"); err == nil {
+		t.Error("Dial over udp succeeded, want error")
+	}
+}
+
+func TestDialUnassignedReplyCode(t *testing.T) {
+	proxy, _ := stubProxy(t, 0x42)
+	d := &client.Dialer{ProxyAddress: proxy}
+
+	_, err := d.Dial("tcp", "192.0.2.1:80")
+	var replyErr *client.ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != 0x42 {
+		t.Fatalf("got error %v, want *ReplyError with code 0x42", err)
+	}
+}
+
+// silentProxy прокси, принимающий соединения и ничего не отвечающий
+func silentProxy(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialContextCancel(t *testing.T) {
+	d := &client.Dialer{ProxyAddress: silentProxy(t)}
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := d.DialContext(ctx, "tcp", "192.0.2.1:80")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("handshake returned %v after cancellation", elapsed)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := d.DialContext(ctx, "tcp", "192.0.2.1:80")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ListenerPolicy настройки сессий, принятых одним листенером
+type ListenerPolicy struct {
+	// Name имя листенера для журналов и API администрирования
+	Name string
+	// TLSConfig настройки TLS, nil - соединения без TLS
+	TLSConfig *tls.Config
+	// Egress исходящие адреса сессий листенера, nil - по настройкам сервера
+	Egress *EgressPool
+}
+
+// EgressPool исходящие адреса подключений к целям, выбираются по кругу
+// среди адресов того же семейства, что и адрес цели
+type EgressPool struct {
+	v4, v6 []net.IP
+	next   atomic.Uint64
+}
+
+// NewEgressPool пул из списка IP-адресов
+func NewEgressPool(addrs []string) (*EgressPool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("empty egress address list")
+	}
+	p := &EgressPool{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address %q", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			p.v4 = append(p.v4, ip4)
+		} else {
+			p.v6 = append(p.v6, ip)
+		}
+	}
+	return p, nil
+}
+
+func (p *EgressPool) String() string {
+	addrs := make([]string, 0, len(p.v4)+len(p.v6))
+	for _, ip := range append(p.v4, p.v6...) {
+		addrs = append(addrs, ip.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+// pick очередной исходящий адрес для подключения к address ("IP:port"),
+// nil - пула нет или в нём нет адресов нужного семейства
+func (p *EgressPool) pick(address string) net.IP {
+	if p == nil {
+		return nil
+	}
+
+	candidates := p.v4
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			candidates = p.v6
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// egressKey ключ пула исходящих адресов в контексте подключения
+type egressKey struct{}
+
+// withEgress контекст подключения с пулом исходящих адресов
+func withEgress(ctx context.Context, pool *EgressPool) context.Context {
+	if pool == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, egressKey{}, pool)
+}
+
+// egressFrom пул исходящих адресов из контекста подключения, nil - не задан
+func egressFrom(ctx context.Context) *EgressPool {
+	pool, _ := ctx.Value(egressKey{}).(*EgressPool)
+	return pool
+}
+
+// egressFor выбор пула исходящих адресов сессии: разрешившее запрос правило
+// доступа, затем пользователь, листенер и настройки сервера
+func (s *Server) egressFor(rule *EgressPool, policy *ListenerPolicy, user string) *EgressPool {
+	if rule != nil {
+		return rule
+	}
+	if pool, ok := s.UserEgress[user]; ok && user != "" {
+		return pool
+	}
+	if policy != nil && policy.Egress != nil {
+		return policy.Egress
+	}
+	return s.Egress
+}
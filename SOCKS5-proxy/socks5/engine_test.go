@@ -0,0 +1,745 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// forEachEngine запуск теста для каждого движка сервера
+func forEachEngine(t *testing.T, test func(t *testing.T, engine string)) {
+	for _, engine := range []string{EngineGoroutine, EngineEpoll} {
+		t.Run(engine, func(t *testing.T) {
+			if engine == EngineEpoll && runtime.GOOS != "linux" {
+				t.Skip("epoll engine is only available on Linux")
+			}
+			test(t, engine)
+		})
+	}
+}
+
+// startProxy запуск srv на случайном порту 127.0.0.1, возвращает адрес прокси
+func startProxy(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	if srv.Logger == nil {
+		srv.Logger = log.New(io.Discard, "", 0)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return listener.Addr().String()
+}
+
+// startEchoTarget целевой сервер, возвращающий всё принятое после того,
+// как клиент закрыл запись, и закрывающий соединение
+func startEchoTarget(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(data)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialProxy подключение к прокси с ограничением времени на весь тест
+func dialProxy(t *testing.T, proxy string) *net.TCPConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+// connectRequest запрос CONNECT к адресу IPv4 "ip:port"
+func connectRequest(t *testing.T, target string) []byte {
+	t.Helper()
+
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{SocksVersion, TCP, Null, IPv4}
+	req = append(req, addr.IP.To4()...)
+	return binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+}
+
+// readReply чтение ответа на запрос с адресом IPv4, возвращает код ответа
+func readReply(t *testing.T, conn net.Conn) byte {
+	t.Helper()
+
+	reply := make([]byte, 10)
+	_, err := io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if reply[0] != SocksVersion || reply[3] != IPv4 {
+		t.Fatalf("malformed reply %x", reply)
+	}
+	return reply[1]
+}
+
+// expect чтение ровно len(want) байт и сравнение с want
+func expect(t *testing.T, conn net.Conn, want []byte, what string) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	_, err := io.ReadFull(conn, got)
+	if err != nil {
+		t.Fatalf("reading %s: %v", what, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s = %x, want %x", what, got, want)
+	}
+}
+
+// relayHalfClose отправка payload через установленный туннель, закрытие записи
+// и проверка, что эхо вернулось целиком и туннель закрылся
+func relayHalfClose(t *testing.T, conn *net.TCPConn, payload []byte) {
+	t.Helper()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		if err == nil {
+			err = conn.CloseWrite()
+		}
+		writeErr <- err
+	}()
+
+	echoed, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("writing payload: %v", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("echoed %d bytes, want the %d bytes sent", len(echoed), len(payload))
+	}
+}
+
+func TestConnectHalfClose(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 2})
+
+		// Больше буферов сокетов, чтобы задействовать отложенную запись
+		payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+		conn := dialProxy(t, proxy)
+		_, err := conn.Write([]byte{SocksVersion, 1, NoAuth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+
+		_, err = conn.Write(connectRequest(t, target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep := readReply(t, conn); rep != Succeeded {
+			t.Fatalf("CONNECT reply %x, want %x", rep, Succeeded)
+		}
+
+		relayHalfClose(t, conn, payload)
+	})
+}
+
+func TestConnectRefusedTarget(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		// Адрес только что закрытого листенера: подключение будет отклонено
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := listener.Addr().String()
+		listener.Close()
+
+		proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1})
+		conn := dialProxy(t, proxy)
+		_, err = conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+		if rep := readReply(t, conn); rep != ConnectionRefused {
+			t.Fatalf("CONNECT reply %x, want %x", rep, ConnectionRefused)
+		}
+	})
+}
+
+func TestUserPassAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewCredentials(map[string]string{"alice": string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userPass := func(user, password string) []byte {
+		msg := []byte{UserPassVersion, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(password)))
+		return append(msg, password...)
+	}
+
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		srv := &Server{
+			Engine:         engine,
+			EpollLoops:     1,
+			Authenticators: []Authenticator{UserPassAuthenticator{Users: users}},
+		}
+		proxy := startProxy(t, srv)
+
+		t.Run("valid", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write([]byte{SocksVersion, 2, NoAuth, UserPass})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, UserPass}, "method selection")
+
+			_, err = conn.Write(userPass("alice", "secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{UserPassVersion, UserPassSuccess}, "auth status")
+
+			_, err = conn.Write(connectRequest(t, target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rep := readReply(t, conn); rep != Succeeded {
+				t.Fatalf("CONNECT reply %x, want %x", rep, Succeeded)
+			}
+			relayHalfClose(t, conn, []byte("hello through an authenticated tunnel"))
+		})
+
+		t.Run("wrong password", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write(append([]byte{SocksVersion, 1, UserPass}, userPass("alice", "wrong")...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, UserPass}, "method selection")
+			expect(t, conn, []byte{UserPassVersion, UserPassFailure}, "auth status")
+		})
+
+		t.Run("no acceptable method", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write([]byte{SocksVersion, 1, NoAuth})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAcceptableAuth}, "method selection")
+		})
+	})
+}
+
+// tokenAuthenticator метод аутентификации по одному байту-токену, которого
+// нет среди встроенных методов
+type tokenAuthenticator struct{}
+
+const tokenMethod = 0x80
+
+func (tokenAuthenticator) Method() byte { return tokenMethod }
+
+func (tokenAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	token := make([]byte, 1)
+	_, err := io.ReadFull(conn, token)
+	if err != nil {
+		return "", err
+	}
+	if token[0] != 0x42 {
+		_, _ = conn.Write([]byte{0x01})
+		return "", errors.New("invalid token")
+	}
+	_, err = conn.Write([]byte{0x00})
+	return "token-user", err
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		srv := &Server{
+			Engine:         engine,
+			EpollLoops:     1,
+			Authenticators: []Authenticator{tokenAuthenticator{}},
+		}
+		proxy := startProxy(t, srv)
+
+		// Приветствие, токен и запрос одним пакетом: движок должен передать
+		// методу аутентификации и байты, пришедшие вслед за приветствием
+		conn := dialProxy(t, proxy)
+		msg := []byte{SocksVersion, 2, NoAuth, tokenMethod, 0x42}
+		_, err := conn.Write(append(msg, connectRequest(t, target)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte{SocksVersion, tokenMethod}, "method selection")
+		expect(t, conn, []byte{0x00}, "token status")
+		if rep := readReply(t, conn); rep != Succeeded {
+			t.Fatalf("CONNECT reply %x, want %x", rep, Succeeded)
+		}
+		relayHalfClose(t, conn, []byte("hello through a custom method"))
+
+		if total := srv.Status().TotalSessions; total != 1 {
+			t.Fatalf("TotalSessions = %d, want 1", total)
+		}
+	})
+}
+
+func TestSOCKS4Connect(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		addr, err := net.ResolveTCPAddr("tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1})
+
+		port := binary.BigEndian.AppendUint16(nil, uint16(addr.Port))
+		requests := map[string][]byte{
+			"socks4":  append(append([]byte{Socks4Version, TCP}, port...), append(addr.IP.To4(), "bob\x00"...)...),
+			"socks4a": append(append([]byte{Socks4Version, TCP}, port...), append([]byte{0, 0, 0, 1}, "bob\x00127.0.0.1\x00"...)...),
+		}
+		for name, req := range requests {
+			t.Run(name, func(t *testing.T) {
+				// Данные вслед за запросом не должны быть поглощены его разбором
+				payload := []byte("data sent together with the request")
+				conn := dialProxy(t, proxy)
+				_, err := conn.Write(append(req, payload...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.CloseWrite(); err != nil {
+					t.Fatal(err)
+				}
+
+				reply := make([]byte, 8)
+				_, err = io.ReadFull(conn, reply)
+				if err != nil {
+					t.Fatalf("reading reply: %v", err)
+				}
+				if reply[1] != Socks4Granted {
+					t.Fatalf("reply %x, want request granted", reply)
+				}
+				echoed, err := io.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(echoed, payload) {
+					t.Fatalf("echoed %q, want %q", echoed, payload)
+				}
+			})
+		}
+	})
+}
+
+func TestAdmissionRejectReplies(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		srv := &Server{Engine: engine, EpollLoops: 1, Limits: AdmissionLimits{MaxSessions: 1}}
+		proxy := startProxy(t, srv)
+
+		// Единственное разрешённое место занято этой сессией
+		holder := dialProxy(t, proxy)
+		_, err := holder.Write([]byte{SocksVersion, 1, NoAuth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, holder, []byte{SocksVersion, NoAuth}, "method selection")
+
+		t.Run("socks5", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, "127.0.0.1:80")...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+			if rep := readReply(t, conn); rep != Failed {
+				t.Fatalf("reply %x, want %x", rep, Failed)
+			}
+		})
+
+		t.Run("socks4", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write([]byte{Socks4Version, TCP, 0, 80, 127, 0, 0, 1, 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 8)
+			_, err = io.ReadFull(conn, reply)
+			if err != nil {
+				t.Fatalf("reading reply: %v", err)
+			}
+			if reply[1] != Socks4Rejected {
+				t.Fatalf("reply %x, want request rejected", reply)
+			}
+		})
+
+		t.Run("http", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write([]byte("CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+			if !bytes.HasPrefix(resp, []byte("HTTP/1.1 503 ")) {
+				t.Fatalf("response %q, want 503", resp)
+			}
+		})
+	})
+}
+
+// requestReply отправка запроса cmd к адресу IPv4 target без аутентификации,
+// возвращает код ответа и BND.ADDR
+func requestReply(t *testing.T, conn net.Conn, cmd byte, target string) (byte, *net.TCPAddr) {
+	t.Helper()
+
+	req := connectRequest(t, target)
+	req[1] = cmd
+	_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, req...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if reply[0] != SocksVersion || reply[3] != IPv4 {
+		t.Fatalf("malformed reply %x", reply)
+	}
+	return reply[1], &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+}
+
+func TestEgressBindsRelayAndListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 needs the whole 127.0.0.0/8 on loopback")
+	}
+	egressIP := net.IPv4(127, 0, 0, 2)
+
+	forEachEngine(t, func(t *testing.T, engine string) {
+		egress, err := NewEgressPool([]string{egressIP.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1, Egress: egress})
+
+		t.Run("bind", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			rep, bnd := requestReply(t, conn, Bind, "127.0.0.1:0")
+			if rep != Succeeded {
+				t.Fatalf("reply %x, want %x", rep, Succeeded)
+			}
+			if !bnd.IP.Equal(egressIP) {
+				t.Fatalf("BIND listens on %s, want the egress address %s", bnd, egressIP)
+			}
+		})
+
+		t.Run("udp", func(t *testing.T) {
+			target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+
+			conn := dialProxy(t, proxy)
+			rep, bnd := requestReply(t, conn, UDPAssociate, "0.0.0.0:0")
+			if rep != Succeeded {
+				t.Fatalf("reply %x, want %x", rep, Succeeded)
+			}
+			if !bnd.IP.Equal(egressIP) {
+				t.Fatalf("UDP relay opened on %s, want the egress address %s", bnd, egressIP)
+			}
+
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bnd.IP, Port: bnd.Port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			targetAddr := target.LocalAddr().(*net.UDPAddr)
+			datagram := append([]byte{0, 0, 0, IPv4}, targetAddr.IP.To4()...)
+			datagram = binary.BigEndian.AppendUint16(datagram, uint16(targetAddr.Port))
+			_, err = client.Write(append(datagram, "ping"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 64)
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("reading relayed datagram: %v", err)
+			}
+			if string(buf[:n]) != "ping" {
+				t.Fatalf("target got %q, want %q", buf[:n], "ping")
+			}
+			if !from.IP.Equal(egressIP) {
+				t.Fatalf("datagram came from %s, want the egress address %s", from, egressIP)
+			}
+		})
+	})
+}
+
+func TestSessionRouteViaUpstream(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		upstreamSrv := &Server{Engine: EngineGoroutine}
+		upstream := startProxy(t, upstreamSrv)
+		chain, err := ParseChain([]string{"socks5://" + upstream}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{Engine: engine, EpollLoops: 1, Dialer: chain}
+		proxy := startProxy(t, srv)
+
+		conn := dialProxy(t, proxy)
+		_, err = conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+		if rep := readReply(t, conn); rep != Succeeded {
+			t.Fatalf("reply %x, want %x", rep, Succeeded)
+		}
+
+		// Адрес цели знает только вышестоящий прокси, подключившийся к ней напрямую
+		sessions := srv.Sessions()
+		if len(sessions) != 1 {
+			t.Fatalf("got %d sessions, want 1", len(sessions))
+		}
+		if got := sessions[0]; got.Resolved != "" || got.Via != "socks5://"+upstream {
+			t.Fatalf("resolved %q via %q, want no address via socks5://%s", got.Resolved, got.Via, upstream)
+		}
+		upstreamSessions := upstreamSrv.Sessions()
+		if len(upstreamSessions) != 1 {
+			t.Fatalf("upstream has %d sessions, want 1", len(upstreamSessions))
+		}
+		if got := upstreamSessions[0]; got.Resolved != target || got.Via != "" {
+			t.Fatalf("upstream resolved %q via %q, want %s directly", got.Resolved, got.Via, target)
+		}
+
+		relayHalfClose(t, conn, []byte("ping"))
+	})
+}
+
+func TestEmptyDomainDoesNotReachLoopback(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		_, port, _ := net.SplitHostPort(target)
+		rules, err := ParseRules([]string{"deny dest=127.0.0.0/8", "allow"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1, Rules: rules})
+
+		t.Run("ip", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+			if rep := readReply(t, conn); rep != NotAllowed {
+				t.Fatalf("reply %x, want %x", rep, NotAllowed)
+			}
+		})
+
+		// Имя нулевой длины дало бы адрес ":port", то есть сам прокси в обход правил
+		t.Run("empty domain", func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			portNum, _ := strconv.Atoi(port)
+			req := binary.BigEndian.AppendUint16([]byte{SocksVersion, TCP, Null, DomainName, 0}, uint16(portNum))
+			_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, req...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+			if rep := readReply(t, conn); rep != Failed {
+				t.Fatalf("reply %x, want %x", rep, Failed)
+			}
+		})
+	})
+}
+
+func TestLiveByteCounters(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		target := startEchoTarget(t)
+		// Нулевые таймауты и отсутствие ограничений скорости - настройки по умолчанию
+		srv := &Server{Engine: engine, EpollLoops: 1}
+		proxy := startProxy(t, srv)
+
+		conn := dialProxy(t, proxy)
+		_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+		if rep := readReply(t, conn); rep != Succeeded {
+			t.Fatalf("reply %x, want %x", rep, Succeeded)
+		}
+
+		// Цель отвечает только после закрытия записи, поэтому туннель пока открыт
+		payload := bytes.Repeat([]byte("x"), 5000)
+		_, err = conn.Write(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sessions := srv.Sessions()
+			if len(sessions) == 1 && sessions[0].BytesUp == int64(len(payload)) &&
+				srv.Status().RelayedUp == uint64(len(payload)) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("sessions %+v, relayed up %d: counters did not reach %d bytes while the tunnel is open",
+					sessions, srv.Status().RelayedUp, len(payload))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		_ = conn.CloseWrite()
+		echoed, err := io.ReadAll(conn)
+		if err != nil || len(echoed) != len(payload) {
+			t.Fatalf("echoed %d bytes (%v), want %d", len(echoed), err, len(payload))
+		}
+	})
+}
+
+// startStreamTarget целевой сервер, отправляющий данные каждые 20 мс в течение d
+// и затем закрывающий соединение; принятое от клиента не читает
+func startStreamTarget(t *testing.T, d time.Duration) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for end := time.Now().Add(d); time.Now().Before(end); {
+					if _, err := conn.Write([]byte("x")); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestIdleTimeoutPerDirection(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine string) {
+		timeouts := Timeouts{IdleUp: 300 * time.Millisecond, IdleDown: time.Minute}
+
+		// Клиент молчит, а цель передаёт: простой направления от клиента закрывает туннель
+		t.Run("silent client", func(t *testing.T) {
+			target := startStreamTarget(t, time.Minute)
+			proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1, Timeouts: timeouts})
+
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+			if rep := readReply(t, conn); rep != Succeeded {
+				t.Fatalf("reply %x, want %x", rep, Succeeded)
+			}
+
+			start := time.Now()
+			_, err = io.Copy(io.Discard, conn)
+			if err != nil && !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("tunnel was not closed by the proxy: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < timeouts.IdleUp {
+				t.Fatalf("tunnel closed after %v, before the %v up limit", elapsed, timeouts.IdleUp)
+			}
+		})
+
+		// Клиент закрыл передачу: завершённое направление простоем не считается
+		t.Run("half-closed client", func(t *testing.T) {
+			const stream = 1500 * time.Millisecond
+			target := startStreamTarget(t, stream)
+			proxy := startProxy(t, &Server{Engine: engine, EpollLoops: 1, Timeouts: timeouts})
+
+			conn := dialProxy(t, proxy)
+			_, err := conn.Write(append([]byte{SocksVersion, 1, NoAuth}, connectRequest(t, target)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(t, conn, []byte{SocksVersion, NoAuth}, "method selection")
+			if rep := readReply(t, conn); rep != Succeeded {
+				t.Fatalf("reply %x, want %x", rep, Succeeded)
+			}
+
+			start := time.Now()
+			if err := conn.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.Copy(io.Discard, conn)
+			if err != nil {
+				t.Fatalf("reading stream: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < stream-100*time.Millisecond {
+				t.Fatalf("tunnel closed after %v while the target was still sending for %v", elapsed, stream)
+			}
+		})
+	})
+}
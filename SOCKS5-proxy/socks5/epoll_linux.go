@@ -0,0 +1,1019 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	epollBufferSize    = 64 * 1024   // общий буфер цикла для пересылки данных
+	epollMaxEvents     = 256         // событий за один вызов epoll_wait
+	epollMaxHandshake  = 1024        // предел накопленных байт рукопожатия
+	epollSweepInterval = time.Second // период проверки таймаутов
+	epollEventsRead    = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	epollEventsWrite   = syscall.EPOLLOUT
+)
+
+// Состояния сессии в событийном цикле
+const (
+	stateGreeting  = iota // ожидание приветствия с методами аутентификации
+	stateAuth             // ожидание имени пользователя и пароля
+	stateVerifying        // проверка пароля в отдельной горутине
+	stateRequest          // ожидание запроса
+	stateDialing          // подключение к удалённому узлу в отдельной горутине
+	stateRelay            // пересылка данных
+)
+
+// epollEndpoint одна из сторон сессии: клиент или удалённый узел
+type epollEndpoint struct {
+	fd      int
+	sess    *epollSession
+	peer    *epollEndpoint
+	pending []byte // данные для записи, не поместившиеся в сокет
+	eof     bool   // при чтении получен EOF
+	paused  bool   // чтение приостановлено ограничением скорости
+	shut    bool   // запись в сокет закрыта
+	events  uint32 // текущая маска событий в epoll
+}
+
+// epollSession сессия клиента в событийном цикле
+type epollSession struct {
+	sessionInfo
+	loop   *epollLoop
+	client *epollEndpoint
+	target *epollEndpoint
+	remote net.Addr // адрес клиента
+	state  int
+	idle   *idleTracker // активность направлений после подключения
+	limit  *sessionLimiter
+	hs     []byte // накопленные байты рукопожатия
+	users  Credentials
+
+	closeAfterFlush bool // закрыть сессию после отправки клиенту ответа об ошибке
+	closed          bool
+}
+
+// epollLoop однопоточный событийный цикл
+type epollLoop struct {
+	srv       *Server
+	epfd      int
+	wakeR     int // канал пробуждения цикла для выполнения задач
+	wakeW     int
+	buf       []byte
+	endpoints map[int]*epollEndpoint
+
+	quit bool // цикл завершается после текущей пачки событий
+
+	mu      sync.Mutex
+	tasks   []func()
+	stopped bool // дескрипторы цикла закрыты, задачи не принимаются
+}
+
+// serveEpoll приём соединений и обслуживание их в n событийных циклах
+// с настройками листенера policy
+func (s *Server) serveEpoll(listener net.Listener, n int, policy *ListenerPolicy) error {
+	loops := make([]*epollLoop, n)
+	for i := range loops {
+		l, err := newEpollLoop(s)
+		if err != nil {
+			for _, started := range loops[:i] {
+				started.stop()
+			}
+			return err
+		}
+		loops[i] = l
+		go l.run()
+	}
+	s.mu.Lock()
+	s.loops = append(s.loops, loops...)
+	s.mu.Unlock()
+	s.logf("Using epoll engine with %d loop(s)", n)
+
+	for i := 0; ; i++ {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			s.logf("Error accepting connection: %v", err)
+			continue
+		}
+
+		if !s.admit(conn) {
+			continue
+		}
+
+		// Без дескриптора (например, TLS) цикл не может читать соединение напрямую
+		if _, ok := conn.(syscall.Conn); !ok {
+			go s.handleClient(conn, policy)
+			continue
+		}
+
+		remote := conn.RemoteAddr()
+		fd, err := detachFD(conn)
+		if err != nil {
+			s.logf("Error detaching connection from %s: %v", remote, err)
+			s.admission.release(remote)
+			continue
+		}
+
+		l := loops[i%n]
+		l.post(func() { l.addClient(fd, remote, policy) })
+	}
+}
+
+// detachFD получение собственного неблокирующего дескриптора соединения
+// и закрытие исходного net.Conn
+func detachFD(conn net.Conn) (int, error) {
+	defer conn.Close()
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, errors.New("connection does not expose a file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	fd := -1
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err != nil {
+		return -1, err
+	}
+	if dupErr != nil {
+		return -1, dupErr
+	}
+
+	syscall.CloseOnExec(fd)
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func newEpollLoop(srv *Server) (*epollLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipe [2]int
+	err = syscall.Pipe2(pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(pipe[0])}
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, pipe[0], &ev)
+	if err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, err
+	}
+
+	return &epollLoop{
+		srv:       srv,
+		epfd:      epfd,
+		wakeR:     pipe[0],
+		wakeW:     pipe[1],
+		buf:       make([]byte, epollBufferSize),
+		endpoints: make(map[int]*epollEndpoint),
+	}, nil
+}
+
+// post постановка задачи на выполнение в потоке цикла.
+// Задачи для остановленного цикла отбрасываются
+func (l *epollLoop) post(task func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return
+	}
+	l.tasks = append(l.tasks, task)
+	_, _ = syscall.Write(l.wakeW, []byte{0})
+}
+
+// stop завершение цикла после выполнения уже поставленных задач
+func (l *epollLoop) stop() {
+	l.post(func() { l.quit = true })
+}
+
+// release закрытие оставшихся дескрипторов после выхода из цикла
+func (l *epollLoop) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopped = true
+	l.tasks = nil
+	for fd := range l.endpoints {
+		syscall.Close(fd)
+	}
+	l.endpoints = nil
+	syscall.Close(l.epfd)
+	syscall.Close(l.wakeR)
+	syscall.Close(l.wakeW)
+}
+
+// runTasks выполнение накопленных задач
+func (l *epollLoop) runTasks() {
+	drain := make([]byte, 64)
+	for {
+		n, _ := syscall.Read(l.wakeR, drain)
+		if n <= 0 {
+			break
+		}
+	}
+
+	l.mu.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.mu.Unlock()
+
+	for _, task := range tasks {
+		task()
+	}
+}
+
+// run основной цикл обработки событий
+func (l *epollLoop) run() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer l.release()
+
+	timeouts := l.srv.Timeouts
+	events := make([]syscall.EpollEvent, epollMaxEvents)
+	wait := -1
+	if timeouts.Handshake > 0 || timeouts.IdleUp > 0 || timeouts.IdleDown > 0 {
+		wait = int(epollSweepInterval / time.Millisecond)
+	}
+	lastSweep := time.Now()
+
+	for !l.quit {
+		n, err := syscall.EpollWait(l.epfd, events, wait)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			l.srv.logf("epoll_wait failed: %v", err)
+			return
+		}
+
+		// Задачи выполняются после обработки пачки событий, чтобы
+		// новые дескрипторы не получили события закрытых ранее
+		wake := false
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeR {
+				wake = true
+				continue
+			}
+			ep, ok := l.endpoints[fd]
+			if !ok {
+				continue
+			}
+			l.handle(ep, events[i].Events)
+		}
+		if wake {
+			l.runTasks()
+		}
+
+		if now := time.Now(); wait > 0 && now.Sub(lastSweep) >= epollSweepInterval {
+			l.sweep(now)
+			lastSweep = now
+		}
+	}
+}
+
+// sweep закрытие сессий, не уложившихся в таймауты рукопожатия или простоя
+func (l *epollLoop) sweep(now time.Time) {
+	for _, ep := range l.endpoints {
+		sess := ep.sess
+		if ep != sess.client || sess.closed {
+			continue
+		}
+
+		switch {
+		case sess.state == stateRelay:
+			if sess.idle.idle(now) {
+				l.srv.logf("Closing idle tunnel %s", sess.remote)
+				l.closeSession(sess)
+			}
+		case sess.state != stateDialing && l.srv.Timeouts.Handshake > 0 && now.Sub(sess.started) > l.srv.Timeouts.Handshake:
+			l.srv.logf("Handshake timeout for %s", sess.remote)
+			l.srv.metrics.handshakeFailed(failTimeout)
+			l.closeSession(sess)
+		}
+	}
+}
+
+// addClient регистрация нового клиентского соединения, принятого листенером с настройками policy
+func (l *epollLoop) addClient(fd int, remote net.Addr, policy *ListenerPolicy) {
+	sess := &epollSession{loop: l, remote: remote, state: stateGreeting}
+	sess.policy = policy
+	sess.begin(l.srv.sessionIDs.Add(1))
+	l.srv.logf("New connection from %s (session %d)", remote, sess.id)
+
+	sess.client = &epollEndpoint{fd: fd, sess: sess}
+	if !l.register(sess.client) {
+		syscall.Close(fd)
+		l.srv.admission.release(remote)
+		return
+	}
+	l.srv.registry.add(sess)
+}
+
+// register добавление дескриптора в epoll
+func (l *epollLoop) register(ep *epollEndpoint) bool {
+	ep.events = l.wantEvents(ep)
+	ev := syscall.EpollEvent{Events: ep.events, Fd: int32(ep.fd)}
+	err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, ep.fd, &ev)
+	if err != nil {
+		l.srv.logf("Error registering descriptor in epoll: %v", err)
+		return false
+	}
+	l.endpoints[ep.fd] = ep
+	return true
+}
+
+// forget удаление дескриптора из epoll без закрытия
+func (l *epollLoop) forget(ep *epollEndpoint) {
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, ep.fd, nil)
+	delete(l.endpoints, ep.fd)
+}
+
+// wantEvents требуемая маска событий для стороны сессии
+func (l *epollLoop) wantEvents(ep *epollEndpoint) uint32 {
+	var events uint32
+	sess := ep.sess
+
+	switch {
+	case sess.closeAfterFlush:
+	case sess.state == stateRelay:
+		// Пока собеседник не принял прошлые данные, новые не читаем
+		if !ep.eof && !ep.paused && len(ep.peer.pending) == 0 {
+			events |= epollEventsRead
+		}
+	case sess.state != stateVerifying && sess.state != stateDialing:
+		events |= epollEventsRead
+	}
+
+	if len(ep.pending) > 0 {
+		events |= epollEventsWrite
+	}
+	return events
+}
+
+// update приведение маски событий в epoll к требуемой
+func (l *epollLoop) update(ep *epollEndpoint) {
+	if ep == nil || ep.sess.closed {
+		return
+	}
+	events := l.wantEvents(ep)
+	if events == ep.events {
+		return
+	}
+
+	ev := syscall.EpollEvent{Events: events, Fd: int32(ep.fd)}
+	err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, ep.fd, &ev)
+	if err != nil {
+		l.srv.logf("Error updating epoll events for %s: %v", ep.sess.remote, err)
+		l.closeSession(ep.sess)
+		return
+	}
+	ep.events = events
+}
+
+// handle обработка событий одного дескриптора
+func (l *epollLoop) handle(ep *epollEndpoint, events uint32) {
+	sess := ep.sess
+
+	if events&syscall.EPOLLERR != 0 {
+		l.closeSession(sess)
+		return
+	}
+	if events&syscall.EPOLLOUT != 0 {
+		l.flush(ep)
+	}
+	if sess.closed {
+		return
+	}
+
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP) != 0 {
+		if ep.events&epollEventsRead == 0 {
+			// Чтение не ожидается: закрытие соединения обрывает сессию
+			if events&syscall.EPOLLHUP != 0 {
+				l.closeSession(sess)
+			}
+			return
+		}
+		if sess.state == stateRelay {
+			l.relay(ep)
+		} else {
+			l.readHandshake(sess)
+		}
+	}
+
+	l.update(sess.client)
+	l.update(sess.target)
+}
+
+// send запись данных с сохранением остатка до готовности сокета
+func (l *epollLoop) send(ep *epollEndpoint, data []byte) {
+	if len(ep.pending) > 0 {
+		ep.pending = append(ep.pending, data...)
+		return
+	}
+
+	n, err := syscall.SendmsgN(ep.fd, data, nil, nil, syscall.MSG_NOSIGNAL)
+	if err != nil && !errors.Is(err, syscall.EAGAIN) {
+		l.closeSession(ep.sess)
+		return
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n < len(data) {
+		ep.pending = append([]byte(nil), data[n:]...)
+	}
+}
+
+// flush дозапись отложенных данных
+func (l *epollLoop) flush(ep *epollEndpoint) {
+	sess := ep.sess
+
+	if len(ep.pending) > 0 {
+		n, err := syscall.SendmsgN(ep.fd, ep.pending, nil, nil, syscall.MSG_NOSIGNAL)
+		if err != nil && !errors.Is(err, syscall.EAGAIN) {
+			l.closeSession(sess)
+			return
+		}
+		if n > 0 {
+			ep.pending = ep.pending[n:]
+			if sess.idle != nil {
+				// Запись к ep продвигает направление, ведущее к нему
+				if ep == sess.client {
+					sess.idle.touch(directionDown)
+				} else {
+					sess.idle.touch(directionUp)
+				}
+			}
+		}
+		if len(ep.pending) > 0 {
+			return
+		}
+		ep.pending = nil
+	}
+
+	if sess.closeAfterFlush {
+		l.closeSession(sess)
+		return
+	}
+	if sess.state == stateRelay && ep.peer.eof {
+		l.shutdown(ep)
+	}
+	l.update(ep)
+	l.update(ep.peer)
+}
+
+// relay пересылка данных, пришедших от одной стороны, другой
+func (l *epollLoop) relay(ep *epollEndpoint) {
+	sess := ep.sess
+	dir := directionUp
+	if ep != sess.client {
+		dir = directionDown
+	}
+
+	buf := l.buf
+	if sess.limit != nil {
+		buf = buf[:sess.limit.chunk(dir)]
+	}
+
+	n, err := syscall.Read(ep.fd, buf)
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			return
+		}
+		l.closeSession(ep.sess)
+		return
+	}
+
+	if n == 0 {
+		ep.eof = true
+		if len(ep.peer.pending) == 0 {
+			l.shutdown(ep.peer)
+		}
+		return
+	}
+
+	sess.idle.touch(dir)
+	sess.bytes[dir].Add(int64(n))
+	l.srv.metrics.relayed(dir, int64(n))
+	l.send(ep.peer, l.buf[:n])
+
+	// При превышении скорости чтение возобновляется после паузы
+	if wait := sess.limit.take(dir, n); wait > 0 {
+		ep.paused = true
+		time.AfterFunc(wait, func() {
+			l.post(func() {
+				ep.paused = false
+				l.update(ep)
+			})
+		})
+	}
+}
+
+// shutdown закрытие записи в сторону ep после EOF от собеседника.
+// Сессия завершается, когда закрыты оба направления
+func (l *epollLoop) shutdown(ep *epollEndpoint) {
+	if !ep.shut {
+		ep.shut = true
+		_ = syscall.Shutdown(ep.fd, syscall.SHUT_WR)
+		// Направление, ведущее к ep, завершено и простоем больше не считается
+		if sess := ep.sess; sess.idle != nil {
+			if ep == sess.client {
+				sess.idle.finish(directionDown)
+			} else {
+				sess.idle.finish(directionUp)
+			}
+		}
+	}
+	if ep.shut && ep.peer.shut {
+		l.closeSession(ep.sess)
+	}
+}
+
+// closeSession закрытие обеих сторон сессии
+func (l *epollLoop) closeSession(sess *epollSession) {
+	if sess.closed {
+		return
+	}
+	sess.closed = true
+	l.srv.registry.remove(sess)
+	l.srv.logAccess(sess.record(sess.remote, sess.user))
+	sess.limit.release()
+	l.srv.admission.release(sess.remote)
+
+	for _, ep := range []*epollEndpoint{sess.client, sess.target} {
+		if ep == nil {
+			continue
+		}
+		l.forget(ep)
+		syscall.Close(ep.fd)
+	}
+}
+
+func (sess *epollSession) status() SessionStatus { return sess.sessionInfo.status(sess.remote) }
+
+// forceClose закрытие сессии в потоке её цикла
+func (sess *epollSession) forceClose() {
+	sess.loop.post(func() { sess.loop.closeSession(sess) })
+}
+
+// replyWith формирование ответа на запрос с запоминанием кода для журнала
+func (sess *epollSession) replyWith(rep byte, addr net.Addr) []byte {
+	sess.setReply(rep)
+	sess.loop.srv.metrics.replySent(rep)
+	switch sess.version {
+	case Socks4Version:
+		return socks4Reply(rep, addr)
+	case HTTPVersion:
+		return httpResponse(httpReplyStatus(rep))
+	default:
+		return replyBytes(rep, addr)
+	}
+}
+
+// reject отправка клиенту ответа об ошибке и закрытие сессии после отправки
+func (l *epollLoop) reject(sess *epollSession, reply []byte) {
+	sess.closeAfterFlush = true
+	l.send(sess.client, reply)
+	if !sess.closed && len(sess.client.pending) == 0 {
+		l.closeSession(sess)
+	}
+}
+
+// readHandshake чтение байт рукопожатия и продвижение конечного автомата
+func (l *epollLoop) readHandshake(sess *epollSession) {
+	n, err := syscall.Read(sess.client.fd, l.buf)
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			return
+		}
+		l.srv.logf("Error reading from %s: %v", sess.remote, err)
+		l.srv.metrics.handshakeFailed(failReadError)
+		l.closeSession(sess)
+		return
+	}
+	if n == 0 {
+		l.srv.logf("Connection from %s closed during handshake", sess.remote)
+		l.srv.metrics.handshakeFailed(failClosed)
+		l.closeSession(sess)
+		return
+	}
+	// Заголовок HTTP-запроса длиннее рукопожатий SOCKS
+	first := l.buf[0]
+	if len(sess.hs) > 0 {
+		first = sess.hs[0]
+	}
+	limit := epollMaxHandshake
+	if isHTTPStart(first) {
+		limit = httpMaxHeader
+	}
+	if len(sess.hs)+n > limit {
+		l.srv.logf("Handshake from %s is too long", sess.remote)
+		l.srv.metrics.handshakeFailed(failTooLong)
+		l.closeSession(sess)
+		return
+	}
+
+	sess.hs = append(sess.hs, l.buf[:n]...)
+	l.advance(sess)
+}
+
+// advance разбор накопленных байт рукопожатия в текущем состоянии
+func (l *epollLoop) advance(sess *epollSession) {
+	for !sess.closed {
+		var done bool
+		switch sess.state {
+		case stateGreeting:
+			done = l.greeting(sess)
+		case stateAuth:
+			done = l.userPass(sess)
+		case stateRequest:
+			done = l.request(sess)
+		default:
+			return
+		}
+		if !done {
+			return
+		}
+	}
+}
+
+// greeting разбор приветствия и выбор метода аутентификации
+func (l *epollLoop) greeting(sess *epollSession) bool {
+	hs := sess.hs
+	if len(hs) > 0 && hs[0] == Socks4Version {
+		sess.setVersion(Socks4Version)
+		return l.socks4Request(sess)
+	}
+	if len(hs) > 0 && isHTTPStart(hs[0]) {
+		sess.setVersion(HTTPVersion)
+		return l.httpRequest(sess)
+	}
+	if len(hs) > 0 && hs[0] != SocksVersion {
+		l.srv.logf("Accepting ONLY SOCKS4, SOCKS5 and HTTP CONNECT connections, got: %x", hs[0])
+		l.srv.metrics.handshakeFailed(failBadVersion)
+		l.closeSession(sess)
+		return false
+	}
+	if len(hs) < 2 || len(hs) < 2+int(hs[1]) {
+		return false
+	}
+	methods := hs[2 : 2+int(hs[1])]
+	sess.hs = hs[2+int(hs[1]):]
+	sess.setVersion(SocksVersion)
+
+	switch auth := l.srv.selectAuthenticator(methods).(type) {
+	case NoAuthAuthenticator:
+		l.send(sess.client, []byte{SocksVersion, NoAuth})
+		sess.state = stateRequest
+		l.srv.logf("Successful connection with client %s", sess.remote)
+	case UserPassAuthenticator:
+		l.send(sess.client, []byte{SocksVersion, UserPass})
+		sess.users = auth.Users
+		sess.state = stateAuth
+	case nil:
+		l.srv.logf("No acceptable auth methods from %s, offered: %x", sess.remote, methods)
+		l.srv.metrics.handshakeFailed(failNoAcceptableAuth)
+		l.reject(sess, []byte{SocksVersion, NoAcceptableAuth})
+		return false
+	default:
+		// Прочим методам нужен блокирующий обмен, сессия продолжается в горутине
+		l.handOver(sess, func(goSess *session) { l.srv.authenticateAndServe(goSess, auth) })
+		return false
+	}
+	return true
+}
+
+// userPass разбор имени пользователя и пароля (RFC 1929).
+// Проверка bcrypt-хэша выполняется вне цикла, чтобы не задерживать остальные сессии
+func (l *epollLoop) userPass(sess *epollSession) bool {
+	hs := sess.hs
+	if len(hs) < 2 || len(hs) < 3+int(hs[1]) {
+		return false
+	}
+	ulen := int(hs[1])
+	plen := int(hs[2+ulen])
+	if len(hs) < 3+ulen+plen {
+		return false
+	}
+
+	if hs[0] != UserPassVersion {
+		l.srv.logf("Authentication of %s failed: unsupported username/password auth version: %x", sess.remote, hs[0])
+		l.srv.metrics.handshakeFailed(failAuth)
+		l.closeSession(sess)
+		return false
+	}
+	user := string(hs[2 : 2+ulen])
+	password := string(hs[3+ulen : 3+ulen+plen])
+	sess.hs = hs[3+ulen+plen:]
+	sess.state = stateVerifying
+
+	users := sess.users
+	go func() {
+		ok := users.Verify(user, password)
+		l.post(func() { l.verified(sess, user, ok) })
+	}()
+	return false
+}
+
+// verified продолжение рукопожатия после проверки пароля
+func (l *epollLoop) verified(sess *epollSession, user string, ok bool) {
+	if sess.closed {
+		return
+	}
+
+	if !ok {
+		l.srv.logf("Authentication of %s failed: invalid credentials for user %q", sess.remote, user)
+		l.srv.metrics.handshakeFailed(failAuth)
+		l.reject(sess, []byte{UserPassVersion, UserPassFailure})
+		return
+	}
+
+	sess.setUser(user)
+	sess.state = stateRequest
+	l.send(sess.client, []byte{UserPassVersion, UserPassSuccess})
+	l.srv.logf("Successful connection with client %s (user %q)", sess.remote, user)
+
+	l.advance(sess)
+	l.update(sess.client)
+}
+
+// request разбор запроса клиента
+func (l *epollLoop) request(sess *epollSession) bool {
+	hs := sess.hs
+	if len(hs) < 4 {
+		return false
+	}
+
+	if hs[0] != SocksVersion {
+		l.srv.logf("Accepting ONLY SOCKS5 connections, got: %x", hs[0])
+		l.srv.metrics.handshakeFailed(failBadVersion)
+		l.reject(sess, sess.replyWith(NotSupportedCommand, nil))
+		return false
+	}
+
+	address, n, err := parseAddr(hs[3:])
+	if errors.Is(err, errShortAddr) {
+		return false
+	}
+	if errors.Is(err, errEmptyDomain) {
+		l.srv.logf("Rejecting request from %s: %v", sess.remote, err)
+		l.srv.metrics.handshakeFailed(failBadAddressType)
+		l.reject(sess, sess.replyWith(Failed, nil))
+		return false
+	}
+	if err != nil {
+		l.srv.logf("Unsupported SOCKS5 address type: %x", hs[3])
+		l.srv.metrics.handshakeFailed(failBadAddressType)
+		l.reject(sess, sess.replyWith(NotSupportedAddressType, nil))
+		return false
+	}
+	sess.hs = hs[3+n:]
+	l.execute(sess, hs[1], address)
+	return false
+}
+
+// socks4Request разбор запроса SOCKS4/SOCKS4a, пришедшего вместо приветствия
+func (l *epollLoop) socks4Request(sess *epollSession) bool {
+	cmd, address, userID, n, err := parseSOCKS4Request(sess.hs)
+	if err != nil {
+		l.srv.logf("Error reading from %s: %v", sess.remote, err)
+		l.srv.metrics.handshakeFailed(socks4Failure(err))
+		l.closeSession(sess)
+		return false
+	}
+	if n == 0 {
+		return false
+	}
+	sess.hs = sess.hs[n:]
+
+	if !l.srv.anonymousAllowed() {
+		l.srv.logf("Rejecting SOCKS4 request from %s: authentication is required", sess.remote)
+		l.srv.metrics.handshakeFailed(failNoAcceptableAuth)
+		l.reject(sess, sess.replyWith(NotAllowed, nil))
+		return false
+	}
+	if cmd != TCP && cmd != Bind {
+		l.srv.logf("Unknown SOCKS4 command: %x", cmd)
+		l.srv.metrics.handshakeFailed(failBadCommand)
+		l.reject(sess, sess.replyWith(NotSupportedCommand, nil))
+		return false
+	}
+
+	if userID != "" {
+		l.srv.logf("SOCKS4 request from %s (userid %q)", sess.remote, userID)
+	} else {
+		l.srv.logf("SOCKS4 request from %s", sess.remote)
+	}
+	l.execute(sess, cmd, address)
+	return false
+}
+
+// httpRequest разбор запроса HTTP-прокси, пришедшего вместо приветствия.
+// Пароль, как и для SOCKS5, проверяется вне цикла
+func (l *epollLoop) httpRequest(sess *epollSession) bool {
+	end := bytes.Index(sess.hs, httpHeaderEnd)
+	if end < 0 {
+		return false
+	}
+	head := sess.hs[:end+len(httpHeaderEnd)]
+	sess.hs = sess.hs[len(head):]
+
+	req, target, status := parseHTTPConnect(head)
+	if status != http.StatusOK {
+		l.rejectHTTP(sess, status, req)
+		return false
+	}
+
+	user, password, creds, ok := l.srv.httpProxyAuth(req, l.srv.anonymousAllowed())
+	if !ok {
+		l.rejectHTTP(sess, http.StatusProxyAuthRequired, req)
+		return false
+	}
+	if creds == nil {
+		l.httpAuthorized(sess, req, "", target, true)
+		return false
+	}
+
+	sess.state = stateVerifying
+	go func() {
+		ok := creds.Verify(user, password)
+		l.post(func() {
+			l.httpAuthorized(sess, req, user, target, ok)
+			l.update(sess.client)
+		})
+	}()
+	return false
+}
+
+// httpAuthorized продолжение запроса HTTP-прокси после проверки учётных данных
+func (l *epollLoop) httpAuthorized(sess *epollSession, req *http.Request, user, target string, ok bool) {
+	if sess.closed {
+		return
+	}
+	if !ok {
+		l.rejectHTTP(sess, http.StatusProxyAuthRequired, req)
+		return
+	}
+
+	sess.setUser(user)
+	if user != "" {
+		l.srv.logf("HTTP CONNECT request from %s (user %q)", sess.remote, user)
+	} else {
+		l.srv.logf("HTTP CONNECT request from %s", sess.remote)
+	}
+	l.execute(sess, TCP, target)
+}
+
+// rejectHTTP отказ клиенту HTTP-прокси до выполнения запроса
+func (l *epollLoop) rejectHTTP(sess *epollSession, status int, req *http.Request) {
+	rep := httpStatusRep(status)
+	l.srv.logf("Rejecting HTTP request from %s: %d %s", sess.remote, status, describeHTTPRequest(req))
+	l.srv.metrics.handshakeFailed(httpFailure(status))
+	sess.setReply(rep)
+	l.srv.metrics.replySent(rep)
+	l.reject(sess, httpResponse(status))
+}
+
+// execute выполнение команды клиента после разбора запроса
+func (l *epollLoop) execute(sess *epollSession, cmd byte, address string) {
+	sess.setRequest(cmd, address)
+
+	switch cmd {
+	case TCP:
+		sess.state = stateDialing
+		go func() {
+			targetConn, via, err := l.srv.dialAllowed(sess.remote, sess.user, sess.policy, address)
+			l.post(func() { l.dialed(sess, address, targetConn, via, err) })
+		}()
+	case Bind, UDPAssociate:
+		l.handOver(sess, func(goSess *session) { l.srv.serveRequest(goSess, cmd, address) })
+	default:
+		l.srv.logf("Unknown command: %x", cmd)
+		l.srv.metrics.handshakeFailed(failBadCommand)
+		l.reject(sess, sess.replyWith(NotSupportedCommand, nil))
+	}
+}
+
+// dialed продолжение сессии после подключения к удалённому узлу
+// напрямую или через цепочку вышестоящих прокси via
+func (l *epollLoop) dialed(sess *epollSession, address string, targetConn net.Conn, via string, err error) {
+	if sess.closed {
+		if targetConn != nil {
+			targetConn.Close()
+		}
+		return
+	}
+
+	if err != nil {
+		rep := dialErrorReply(err)
+		l.srv.logf("Error connecting to %s (reply %x): %v", address, rep, err)
+		l.reject(sess, sess.replyWith(rep, nil))
+		return
+	}
+
+	localAddr := targetConn.LocalAddr()
+	sess.setRoute(targetConn.RemoteAddr(), via)
+	fd, err := detachFD(targetConn)
+	if err != nil {
+		l.srv.logf("Error detaching connection to %s: %v", address, err)
+		l.reject(sess, sess.replyWith(Failed, nil))
+		return
+	}
+
+	sess.state = stateRelay
+	sess.idle = newIdleTracker(l.srv.Timeouts)
+	sess.limit = l.srv.buckets.newSessionLimiter(sess.remote, sess.user)
+	sess.target = &epollEndpoint{fd: fd, sess: sess, peer: sess.client}
+	sess.client.peer = sess.target
+	if !l.register(sess.target) {
+		syscall.Close(fd)
+		sess.target = nil
+		l.closeSession(sess)
+		return
+	}
+
+	l.send(sess.client, sess.replyWith(Succeeded, localAddr))
+	if sess.user != "" {
+		l.srv.logf("Successfully connected to %s for user %q", address, sess.user)
+	} else {
+		l.srv.logf("Successfully connected to %s", address)
+	}
+
+	// Данные, отправленные клиентом вслед за запросом
+	if len(sess.hs) > 0 {
+		l.send(sess.target, sess.hs)
+	}
+	sess.hs = nil
+
+	l.update(sess.client)
+	l.update(sess.target)
+}
+
+// handOver передача сессии в обработку горутиной: команды BIND и UDP ASSOCIATE,
+// а также методы аутентификации, которым нужен блокирующий обмен.
+// Непрочитанные байты рукопожатия достаются serve вместе с соединением
+func (l *epollLoop) handOver(sess *epollSession, serve func(goSess *session)) {
+	l.forget(sess.client)
+	sess.closed = true
+
+	file := os.NewFile(uintptr(sess.client.fd), sess.remote.String())
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		l.srv.logf("Error handing over connection from %s: %v", sess.remote, err)
+		l.srv.registry.remove(sess)
+		l.srv.logAccess(sess.record(sess.remote, sess.user))
+		l.srv.admission.release(sess.remote)
+		return
+	}
+
+	if len(sess.hs) > 0 {
+		pending := bytes.NewReader(sess.hs)
+		conn = &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(pending, conn))}
+	}
+
+	goSess := &session{srv: l.srv, conn: conn}
+	goSess.id, goSess.started = sess.id, sess.started
+	goSess.version, goSess.user = sess.version, sess.user
+	goSess.policy = sess.policy
+	l.srv.registry.replace(sess, goSess)
+
+	go func() {
+		defer conn.Close()
+		defer l.srv.registry.remove(goSess)
+		defer l.srv.admission.release(sess.remote)
+		defer func() { l.srv.logAccess(goSess.record(sess.remote, goSess.user)) }()
+		serve(goSess)
+	}()
+}
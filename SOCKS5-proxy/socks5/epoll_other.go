@@ -0,0 +1,18 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+// epollLoop событийный цикл, в этой системе не используется
+type epollLoop struct{}
+
+func (*epollLoop) stop() {}
+
+// serveEpoll событийный движок доступен только в Linux
+func (s *Server) serveEpoll(net.Listener, int, *ListenerPolicy) error {
+	return errors.New("epoll engine is only available on Linux")
+}
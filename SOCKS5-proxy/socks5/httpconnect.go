@@ -0,0 +1,219 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HTTPVersion условный номер версии протокола для сессий HTTP CONNECT
+	HTTPVersion = 'H'
+
+	httpMaxHeader = 8 * 1024 // предел размера заголовка запроса HTTP CONNECT
+	httpRealm     = "proxy"  // область защиты в Proxy-Authenticate
+)
+
+// errHTTPHeaderTooLong заголовок запроса длиннее допустимого
+var errHTTPHeaderTooLong = errors.New("HTTP request header is too long")
+
+// httpHeaderEnd признак конца заголовка запроса
+var httpHeaderEnd = []byte("\r\n\r\n")
+
+// isHTTPStart похоже ли начало соединения на HTTP-запрос: методы HTTP
+// начинаются с заглавной латинской буквы, а запросы SOCKS - с номера версии
+func isHTTPStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// readHTTPHead чтение заголовка HTTP-запроса, первый байт которого уже прочитан.
+// Заголовок читается побайтно, чтобы данные клиента за ним остались в сокете
+func readHTTPHead(r io.Reader, first byte) ([]byte, error) {
+	head := []byte{first}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, httpHeaderEnd) {
+		if len(head) == httpMaxHeader {
+			return nil, errHTTPHeaderTooLong
+		}
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return head, nil
+}
+
+// readHTTPRequest чтение запроса HTTP-прокси, первый байт которого уже прочитан.
+// Возвращает команду CONNECT и целевой адрес в виде "host:port"
+func (s *Server) readHTTPRequest(sess *session, first byte) (byte, string, bool) {
+	conn := sess.conn
+
+	head, err := readHTTPHead(conn, first)
+	if err != nil {
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		if errors.Is(err, errHTTPHeaderTooLong) {
+			s.metrics.handshakeFailed(failTooLong)
+		} else {
+			s.metrics.handshakeFailed(readFailure(err))
+		}
+		return 0, "", false
+	}
+
+	req, target, status := parseHTTPConnect(head)
+	if status != http.StatusOK {
+		s.rejectHTTP(sess, status, req)
+		return 0, "", false
+	}
+
+	user, password, creds, ok := s.httpProxyAuth(req, sess.identity != "" || s.anonymousAllowed())
+	if ok && creds != nil {
+		ok = creds.Verify(user, password)
+	}
+	if !ok {
+		s.rejectHTTP(sess, http.StatusProxyAuthRequired, req)
+		return 0, "", false
+	}
+	if user != "" {
+		sess.setUser(user)
+	}
+
+	if sess.user != "" {
+		s.logf("HTTP CONNECT request from %s (user %q)", conn.RemoteAddr().String(), sess.user)
+	} else {
+		s.logf("HTTP CONNECT request from %s", conn.RemoteAddr().String())
+	}
+	return TCP, target, true
+}
+
+// rejectHTTP отказ клиенту HTTP-прокси до выполнения запроса
+func (s *Server) rejectHTTP(sess *session, status int, req *http.Request) {
+	rep := httpStatusRep(status)
+	s.logf("Rejecting HTTP request from %s: %d %s", sess.conn.RemoteAddr().String(), status, describeHTTPRequest(req))
+	s.metrics.handshakeFailed(httpFailure(status))
+	sess.setReply(rep)
+	s.metrics.replySent(rep)
+	_, _ = sess.conn.Write(httpResponse(status))
+}
+
+// parseHTTPConnect разбор заголовка запроса HTTP-прокси.
+// Возвращает запрос, целевой адрес и http.StatusOK либо код отказа
+func parseHTTPConnect(head []byte) (*http.Request, string, int) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, "", http.StatusBadRequest
+	}
+	if req.Method != http.MethodConnect {
+		return req, "", http.StatusMethodNotAllowed
+	}
+
+	// Цель CONNECT задаётся в виде "host:port" (RFC 9110, раздел 9.3.6)
+	host, port, err := net.SplitHostPort(req.RequestURI)
+	if err != nil || host == "" || port == "" {
+		return req, "", http.StatusBadRequest
+	}
+	return req, net.JoinHostPort(host, port), http.StatusOK
+}
+
+// httpProxyAuth разбор заголовка Proxy-Authorization по настройкам аутентификации сервера,
+// anonymous - допустим ли клиент без учётных данных.
+// ok == false - запрос нужно отклонить; непустой creds - пароль нужно проверить по нему
+func (s *Server) httpProxyAuth(req *http.Request, anonymous bool) (user, password string, creds Credentials, ok bool) {
+	for _, auth := range s.authenticators() {
+		if up, isUserPass := auth.(UserPassAuthenticator); isUserPass {
+			creds = up.Users
+			break
+		}
+	}
+
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" || creds == nil {
+		// Без учётных данных клиент обслуживается, только если это допустимо
+		return "", "", nil, anonymous
+	}
+
+	scheme, encoded, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", "", nil, false
+	}
+	// Разбор Basic делегируется net/http через временный запрос
+	probe := &http.Request{Header: http.Header{"Authorization": {"Basic " + strings.TrimSpace(encoded)}}}
+	user, password, ok = probe.BasicAuth()
+	if !ok {
+		return "", "", nil, false
+	}
+	return user, password, creds, true
+}
+
+// httpResponse ответ HTTP-прокси с кодом status без тела
+func httpResponse(status int) []byte {
+	if status == http.StatusOK {
+		return []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	switch status {
+	case http.StatusProxyAuthRequired:
+		fmt.Fprintf(&b, "Proxy-Authenticate: Basic realm=%q\r\n", httpRealm)
+	case http.StatusMethodNotAllowed:
+		b.WriteString("Allow: CONNECT\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	return []byte(b.String())
+}
+
+// httpReplyStatus код ответа HTTP, соответствующий коду ответа SOCKS5
+func httpReplyStatus(rep byte) int {
+	switch rep {
+	case Succeeded:
+		return http.StatusOK
+	case NotAllowed:
+		return http.StatusForbidden
+	case TTLExpired:
+		return http.StatusGatewayTimeout
+	case NotSupportedCommand:
+		return http.StatusMethodNotAllowed
+	case NotSupportedAddressType:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// httpStatusRep код ответа SOCKS5 для журнала и метрик по коду отказа HTTP
+func httpStatusRep(status int) byte {
+	switch status {
+	case http.StatusProxyAuthRequired, http.StatusForbidden:
+		return NotAllowed
+	case http.StatusMethodNotAllowed:
+		return NotSupportedCommand
+	default:
+		return Failed
+	}
+}
+
+// httpFailure причина неудачного рукопожатия HTTP для метрик
+func httpFailure(status int) string {
+	switch status {
+	case http.StatusProxyAuthRequired:
+		return failAuth
+	case http.StatusMethodNotAllowed:
+		return failBadCommand
+	default:
+		return failBadHTTPRequest
+	}
+}
+
+// describeHTTPRequest краткое описание запроса для журнала
+func describeHTTPRequest(req *http.Request) string {
+	if req == nil {
+		return "malformed request"
+	}
+	return fmt.Sprintf("%s %s", req.Method, req.RequestURI)
+}
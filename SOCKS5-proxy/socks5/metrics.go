@@ -0,0 +1,232 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Причины неудачного рукопожатия
+const (
+	failClosed           = "closed"             // клиент закрыл соединение
+	failReadError        = "read_error"         // ошибка чтения или записи
+	failTimeout          = "timeout"            // не уложился в таймаут рукопожатия
+	failBadVersion       = "bad_version"        // версия протокола не SOCKS5
+	failNoAcceptableAuth = "no_acceptable_auth" // нет подходящего метода аутентификации
+	failAuth             = "auth_failed"        // неверные учётные данные
+	failBadCommand       = "unsupported_command"
+	failBadAddressType   = "unsupported_address_type"
+	failTooLong          = "too_long" // рукопожатие не помещается в буфер
+	failBadHTTPRequest   = "bad_http_request"
+	failTLS              = "tls_handshake" // не удалось согласование TLS
+)
+
+// dialLatencyBuckets верхние границы корзин гистограммы времени подключения, секунды
+var dialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// replyNames названия кодов ответа для меток
+var replyNames = map[byte]string{
+	Succeeded:               "succeeded",
+	Failed:                  "general_failure",
+	NotAllowed:              "not_allowed",
+	NetworkUnreachable:      "network_unreachable",
+	HostUnreachable:         "host_unreachable",
+	ConnectionRefused:       "connection_refused",
+	TTLExpired:              "ttl_expired",
+	NotSupportedCommand:     "command_not_supported",
+	NotSupportedAddressType: "address_type_not_supported",
+}
+
+// proxyMetrics счётчики работы прокси для экспорта в формате Prometheus
+type proxyMetrics struct {
+	bytes [2]atomic.Uint64 // переданные байты по направлениям
+
+	mu                sync.Mutex
+	handshakeFailures map[string]uint64
+	replies           map[byte]uint64
+	admissionRejects  map[string]uint64
+	ports             map[int]uint64 // попытки подключения по порту назначения
+	dialBuckets       []uint64       // количество подключений не дольше границы корзины
+	dialCount         uint64
+	dialSum           time.Duration
+}
+
+// newProxyMetrics создание пустых счётчиков
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		handshakeFailures: make(map[string]uint64),
+		replies:           make(map[byte]uint64),
+		admissionRejects:  make(map[string]uint64),
+		ports:             make(map[int]uint64),
+		dialBuckets:       make([]uint64, len(dialLatencyBuckets)),
+	}
+}
+
+// handshakeFailed учёт неудачного рукопожатия
+func (m *proxyMetrics) handshakeFailed(reason string) {
+	m.mu.Lock()
+	m.handshakeFailures[reason]++
+	m.mu.Unlock()
+}
+
+// admissionRejected учёт соединения, отклонённого ограничениями на приём
+func (m *proxyMetrics) admissionRejected(reason string) {
+	m.mu.Lock()
+	m.admissionRejects[reason]++
+	m.mu.Unlock()
+}
+
+// replySent учёт отправленного кода ответа
+func (m *proxyMetrics) replySent(rep byte) {
+	m.mu.Lock()
+	m.replies[rep]++
+	m.mu.Unlock()
+}
+
+// relayed учёт переданных в направлении dir байт
+func (m *proxyMetrics) relayed(dir int, n int64) {
+	if n > 0 {
+		m.bytes[dir].Add(uint64(n))
+	}
+}
+
+// dialed учёт попытки подключения к порту назначения и её длительности
+func (m *proxyMetrics) dialed(port int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ports[port]++
+	m.dialCount++
+	m.dialSum += d
+	for i, bound := range dialLatencyBuckets {
+		if d.Seconds() <= bound {
+			m.dialBuckets[i]++
+		}
+	}
+}
+
+// readFailure причина неудачного рукопожатия по ошибке чтения
+func readFailure(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return failTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return failClosed
+	default:
+		return failReadError
+	}
+}
+
+// writeMetrics вывод метрик в текстовом формате Prometheus
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	active, total := s.registry.count()
+	fmt.Fprintln(w, "# HELP socks5_connections_active Client connections currently being served.")
+	fmt.Fprintln(w, "# TYPE socks5_connections_active gauge")
+	fmt.Fprintf(w, "socks5_connections_active %d\n", active)
+	fmt.Fprintln(w, "# HELP socks5_connections_total Client connections accepted since start.")
+	fmt.Fprintln(w, "# TYPE socks5_connections_total counter")
+	fmt.Fprintf(w, "socks5_connections_total %d\n", total)
+
+	fmt.Fprintln(w, "# HELP socks5_relayed_bytes_total Bytes relayed through CONNECT tunnels.")
+	fmt.Fprintln(w, "# TYPE socks5_relayed_bytes_total counter")
+	fmt.Fprintf(w, "socks5_relayed_bytes_total{direction=\"up\"} %d\n", m.bytes[directionUp].Load())
+	fmt.Fprintf(w, "socks5_relayed_bytes_total{direction=\"down\"} %d\n", m.bytes[directionDown].Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP socks5_handshake_failures_total Failed client handshakes by reason.")
+	fmt.Fprintln(w, "# TYPE socks5_handshake_failures_total counter")
+	reasons := make([]string, 0, len(m.handshakeFailures))
+	for reason := range m.handshakeFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "socks5_handshake_failures_total{reason=%q} %d\n", reason, m.handshakeFailures[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP socks5_admission_rejections_total Connections rejected by admission limits by reason.")
+	fmt.Fprintln(w, "# TYPE socks5_admission_rejections_total counter")
+	reasons = reasons[:0]
+	for reason := range m.admissionRejects {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "socks5_admission_rejections_total{reason=%q} %d\n", reason, m.admissionRejects[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP socks5_replies_total Replies sent to clients by REP code.")
+	fmt.Fprintln(w, "# TYPE socks5_replies_total counter")
+	codes := make([]int, 0, len(m.replies))
+	for rep := range m.replies {
+		codes = append(codes, int(rep))
+	}
+	sort.Ints(codes)
+	for _, rep := range codes {
+		name, ok := replyNames[byte(rep)]
+		if !ok {
+			name = "unassigned"
+		}
+		fmt.Fprintf(w, "socks5_replies_total{code=\"%d\",reply=%q} %d\n", rep, name, m.replies[byte(rep)])
+	}
+
+	fmt.Fprintln(w, "# HELP socks5_dial_duration_seconds Time to connect to targets, including upstream proxies.")
+	fmt.Fprintln(w, "# TYPE socks5_dial_duration_seconds histogram")
+	for i, bound := range dialLatencyBuckets {
+		fmt.Fprintf(w, "socks5_dial_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.dialBuckets[i])
+	}
+	fmt.Fprintf(w, "socks5_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.dialCount)
+	fmt.Fprintf(w, "socks5_dial_duration_seconds_sum %g\n", m.dialSum.Seconds())
+	fmt.Fprintf(w, "socks5_dial_duration_seconds_count %d\n", m.dialCount)
+
+	fmt.Fprintln(w, "# HELP socks5_destination_port_dials_total Connection attempts by destination port.")
+	fmt.Fprintln(w, "# TYPE socks5_destination_port_dials_total counter")
+	ports := make([]int, 0, len(m.ports))
+	for port := range m.ports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		fmt.Fprintf(w, "socks5_destination_port_dials_total{port=\"%d\"} %d\n", port, m.ports[port])
+	}
+
+	if s.Resolver != nil {
+		stats := s.Resolver.Stats()
+		fmt.Fprintln(w, "# HELP socks5_dns_lookups_total Name lookups by the caching resolver.")
+		fmt.Fprintln(w, "# TYPE socks5_dns_lookups_total counter")
+		fmt.Fprintf(w, "socks5_dns_lookups_total %d\n", stats.Lookups)
+		fmt.Fprintln(w, "# HELP socks5_dns_cache_hits_total Lookups answered from the cache.")
+		fmt.Fprintln(w, "# TYPE socks5_dns_cache_hits_total counter")
+		fmt.Fprintf(w, "socks5_dns_cache_hits_total %d\n", stats.CacheHits)
+		fmt.Fprintln(w, "# HELP socks5_dns_queries_total Queries sent to DNS servers.")
+		fmt.Fprintln(w, "# TYPE socks5_dns_queries_total counter")
+		fmt.Fprintf(w, "socks5_dns_queries_total %d\n", stats.Queries)
+		fmt.Fprintln(w, "# HELP socks5_dns_failures_total Failed queries to DNS servers.")
+		fmt.Fprintln(w, "# TYPE socks5_dns_failures_total counter")
+		fmt.Fprintf(w, "socks5_dns_failures_total %d\n", stats.Failures)
+		fmt.Fprintln(w, "# HELP socks5_dns_resolve_duration_seconds Time to resolve names not found in the cache.")
+		fmt.Fprintln(w, "# TYPE socks5_dns_resolve_duration_seconds summary")
+		fmt.Fprintf(w, "socks5_dns_resolve_duration_seconds_sum %g\n", stats.TotalLatency.Seconds())
+		fmt.Fprintf(w, "socks5_dns_resolve_duration_seconds_count %d\n", stats.Queries)
+	}
+}
+
+// MetricsHandler HTTP-обработчик, отдающий метрики в текстовом формате Prometheus
+func (s *Server) MetricsHandler() http.Handler {
+	s.setupOnce.Do(s.setup)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+}
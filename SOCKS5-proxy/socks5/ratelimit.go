@@ -0,0 +1,241 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateMinBurst = 512 // наименьший запас корзины, байт
+
+// ByteRate скорость в байтах в секунду, 0 - без ограничения.
+// Реализует flag.Value и encoding.TextUnmarshaler: допускаются суффиксы K, M и G (степени 1024)
+type ByteRate int64
+
+func (r *ByteRate) UnmarshalText(text []byte) error { return r.Set(string(text)) }
+
+func (r *ByteRate) String() string { return strconv.FormatInt(int64(*r), 10) }
+
+func (r *ByteRate) Set(s string) error {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	*r = ByteRate(v * mult)
+	return nil
+}
+
+// RateLimits ограничения скорости, индекс массива - направление:
+// 0 - от клиента к цели, 1 - от цели к клиенту
+type RateLimits struct {
+	Global [2]ByteRate // на весь прокси
+	Client [2]ByteRate // на IP-адрес клиента
+	User   [2]ByteRate // на аутентифицированного пользователя
+}
+
+// tokenBucket корзина токенов: rate байт в секунду с запасом не больше burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket корзина с запасом на десятую долю секунды,
+// чтобы передача шла равномерно, а не рывками раз в секунду
+func newTokenBucket(rate ByteRate) *tokenBucket {
+	burst := min(max(int64(rate)/10, rateMinBurst), relayBufferSize)
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take списание n байт. Возвращает, сколько нужно подождать, чтобы передача
+// уложилась в скорость; запас уходит в минус, и следующие передачи ждут дольше
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow списание n токенов, только если их хватает
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// pooledBuckets корзины одного клиента или пользователя, общие для его сессий
+type pooledBuckets struct {
+	buckets [2]*tokenBucket
+	refs    int
+}
+
+// bucketPool корзины по ключу, удаляемые с завершением последней сессии
+type bucketPool struct {
+	mu      sync.Mutex
+	buckets map[string]*pooledBuckets
+}
+
+// bandwidthBuckets корзины сервера по заданным ограничениям
+type bandwidthBuckets struct {
+	limits RateLimits
+	global [2]*tokenBucket
+	client *bucketPool
+	user   *bucketPool
+}
+
+// newBandwidthBuckets создание общих корзин по заданным ограничениям
+func newBandwidthBuckets(limits RateLimits) *bandwidthBuckets {
+	b := &bandwidthBuckets{
+		limits: limits,
+		client: &bucketPool{buckets: make(map[string]*pooledBuckets)},
+		user:   &bucketPool{buckets: make(map[string]*pooledBuckets)},
+	}
+	for dir, rate := range limits.Global {
+		if rate > 0 {
+			b.global[dir] = newTokenBucket(rate)
+		}
+	}
+	return b
+}
+
+func (p *bucketPool) acquire(key string, rates [2]ByteRate) [2]*tokenBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pb, ok := p.buckets[key]
+	if !ok {
+		pb = &pooledBuckets{}
+		for dir, rate := range rates {
+			if rate > 0 {
+				pb.buckets[dir] = newTokenBucket(rate)
+			}
+		}
+		p.buckets[key] = pb
+	}
+	pb.refs++
+	return pb.buckets
+}
+
+func (p *bucketPool) release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pb := p.buckets[key]
+	pb.refs--
+	if pb.refs == 0 {
+		delete(p.buckets, key)
+	}
+}
+
+// sessionLimiter ограничения скорости, действующие для одной сессии.
+// Нулевой указатель означает отсутствие ограничений
+type sessionLimiter struct {
+	buckets   [2][]*tokenBucket
+	pools     *bandwidthBuckets
+	clientKey string
+	userKey   string
+}
+
+// newSessionLimiter подбор корзин для сессии клиента client с пользователем user
+func (b *bandwidthBuckets) newSessionLimiter(client net.Addr, user string) *sessionLimiter {
+	l := &sessionLimiter{pools: b}
+	add := func(buckets [2]*tokenBucket) {
+		for dir, b := range buckets {
+			if b != nil {
+				l.buckets[dir] = append(l.buckets[dir], b)
+			}
+		}
+	}
+
+	add(b.global)
+	if b.limits.Client != [2]ByteRate{} {
+		l.clientKey = clientHost(client)
+		add(b.client.acquire(l.clientKey, b.limits.Client))
+	}
+	if user != "" && b.limits.User != [2]ByteRate{} {
+		l.userKey = user
+		add(b.user.acquire(user, b.limits.User))
+	}
+
+	if len(l.buckets[directionUp]) == 0 && len(l.buckets[directionDown]) == 0 {
+		l.release()
+		return nil
+	}
+	return l
+}
+
+// release освобождение корзин клиента и пользователя
+func (l *sessionLimiter) release() {
+	if l == nil {
+		return
+	}
+	if l.clientKey != "" {
+		l.pools.client.release(l.clientKey)
+		l.clientKey = ""
+	}
+	if l.userKey != "" {
+		l.pools.user.release(l.userKey)
+		l.userKey = ""
+	}
+}
+
+// chunk наибольший размер порции данных направления dir, не превышающий запаса корзин
+func (l *sessionLimiter) chunk(dir int) int {
+	size := relayBufferSize
+	if l == nil {
+		return size
+	}
+	for _, b := range l.buckets[dir] {
+		size = min(size, int(b.burst))
+	}
+	return size
+}
+
+// take списание n байт направления dir со всех корзин.
+// Возвращает наибольшее из требуемых ожиданий
+func (l *sessionLimiter) take(dir, n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	var wait time.Duration
+	for _, b := range l.buckets[dir] {
+		wait = max(wait, b.take(n))
+	}
+	return wait
+}
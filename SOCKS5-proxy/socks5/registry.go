@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// trackedSession активная сессия, которую можно осмотреть и принудительно закрыть
+type trackedSession interface {
+	status() SessionStatus
+	forceClose()
+}
+
+// sessionRegistry учёт активных сессий
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[trackedSession]struct{}
+	total    uint64 // всего сессий с момента запуска
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[trackedSession]struct{})}
+}
+
+func (r *sessionRegistry) add(s trackedSession) {
+	r.mu.Lock()
+	r.sessions[s] = struct{}{}
+	r.total++
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(s trackedSession) {
+	r.mu.Lock()
+	delete(r.sessions, s)
+	r.mu.Unlock()
+}
+
+// replace замена записи сессии при смене её обработчика без учёта новой сессии
+func (r *sessionRegistry) replace(old, s trackedSession) {
+	r.mu.Lock()
+	delete(r.sessions, old)
+	r.sessions[s] = struct{}{}
+	r.mu.Unlock()
+}
+
+// count количество активных сессий и общее число сессий
+func (r *sessionRegistry) count() (int, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions), r.total
+}
+
+// list снимок списка активных сессий
+func (r *sessionRegistry) list() []trackedSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]trackedSession, 0, len(r.sessions))
+	for s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// wait ожидание завершения всех сессий, пока не завершится ctx
+func (r *sessionRegistry) wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if active, _ := r.count(); active == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeAll принудительное закрытие всех активных сессий.
+// Возвращает количество закрытых сессий
+func (r *sessionRegistry) closeAll() int {
+	sessions := r.list()
+	for _, s := range sessions {
+		s.forceClose()
+	}
+	return len(sessions)
+}
+
+// track регистрация ресурса сессии, закрываемого при принудительном завершении
+func (s *session) track(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.forced {
+		c.Close()
+		return
+	}
+	s.closers = append(s.closers, c)
+}
+
+// forceClose закрытие клиентского соединения и всех ресурсов сессии
+func (s *session) forceClose() {
+	s.mu.Lock()
+	s.forced = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, c := range closers {
+		c.Close()
+	}
+}
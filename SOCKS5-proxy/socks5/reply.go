@@ -0,0 +1,54 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"SOCKS5-proxy/socks5/client"
+)
+
+// dialErrorReply определение кода ответа SOCKS5 по ошибке подключения к удалённому узлу
+func dialErrorReply(err error) byte {
+	if errors.Is(err, errNotAllowed) {
+		return NotAllowed
+	}
+
+	// Вышестоящий прокси сам сообщил причину отказа
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return upErr.rep
+	}
+	var replyErr *client.ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		// Имя не разрешилось - узел недостижим
+		return HostUnreachable
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return HostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		// Соединение запрещено локальными правилами (например, фаерволом)
+		return NotAllowed
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, os.ErrDeadlineExceeded):
+		return TTLExpired
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TTLExpired
+	}
+
+	return Failed
+}
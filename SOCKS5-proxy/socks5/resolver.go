@@ -0,0 +1,433 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsMaxTTL      = time.Hour        // верхняя граница времени жизни записи в кэше
+	dnsUDPSize     = 1232             // размер буфера для ответа по UDP
+	dnsDefaultPort = "53"             // порт DNS-сервера, если он не указан
+	dnsNegativeTTL = 30 * time.Second // время кэширования отрицательного ответа без SOA
+)
+
+// dnsCacheEntry запись кэша: адреса или ошибка разрешения имени
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsCall выполняющийся запрос к DNS-серверу, общий для всех ожидающих
+type dnsCall struct {
+	done  chan struct{}
+	entry *dnsCacheEntry
+}
+
+// ResolverStats статистика работы резолвера
+type ResolverStats struct {
+	Lookups      uint64        // всего запросов на разрешение имени
+	CacheHits    uint64        // ответов из кэша (включая отрицательные)
+	Queries      uint64        // обращений к DNS-серверам
+	Failures     uint64        // неудачных обращений к DNS-серверам
+	TotalLatency time.Duration // суммарное время обращений к DNS-серверам
+	LastLatency  time.Duration // время последнего обращения
+}
+
+// Resolver кэширующий DNS-резолвер. Нулевой указатель означает системный резолвер
+type Resolver struct {
+	// Logger журнал результатов разрешения имён, nil - стандартный журнал пакета log
+	Logger Logger
+
+	servers []string // адреса DNS-серверов "ip:port" в порядке опроса
+	useTCP  bool     // запросы только по TCP, иначе UDP с переходом на TCP при усечении
+	timeout time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]*dnsCacheEntry
+	inflight map[string]*dnsCall
+	stats    ResolverStats
+}
+
+// NewResolver создание резолвера по списку серверов вида "ip" или "ip:port".
+// timeout - ограничение одного обращения к серверу, должно быть положительным:
+// без него потерянная UDP-датаграмма навсегда задержала бы все ожидающие это имя запросы
+func NewResolver(servers []string, useTCP bool, timeout time.Duration) (*Resolver, error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("DNS timeout must be positive, got %v", timeout)
+	}
+
+	r := &Resolver{
+		useTCP:   useTCP,
+		timeout:  timeout,
+		cache:    make(map[string]*dnsCacheEntry),
+		inflight: make(map[string]*dnsCall),
+	}
+
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, dnsDefaultPort)
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DNS server address: %q", server)
+		}
+		r.servers = append(r.servers, server)
+	}
+	if len(r.servers) == 0 {
+		return nil, errors.New("no DNS servers configured")
+	}
+
+	return r, nil
+}
+
+// Servers адреса DNS-серверов в порядке опроса
+func (r *Resolver) Servers() []string {
+	return r.servers
+}
+
+// ResolveAddress разрешение "host:port" в список адресов "ip:port".
+// IP-адреса и имена без настроенного резолвера возвращаются как есть
+func (r *Resolver) ResolveAddress(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+
+	ips, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return addresses, nil
+}
+
+// LookupIPs разрешение имени настроенным резолвером, а при его отсутствии - системным
+func (r *Resolver) LookupIPs(host string) ([]net.IP, error) {
+	if r != nil {
+		return r.lookup(host)
+	}
+	return net.LookupIP(host)
+}
+
+// lookup разрешение имени с использованием кэша.
+// Одновременные запросы одного имени объединяются в одно обращение к серверу
+func (r *Resolver) lookup(host string) ([]net.IP, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	r.stats.Lookups++
+	if entry, ok := r.cache[name]; ok && time.Now().Before(entry.expires) {
+		r.stats.CacheHits++
+		r.mu.Unlock()
+		return entry.ips, entry.err
+	}
+	if call, ok := r.inflight[name]; ok {
+		r.mu.Unlock()
+		<-call.done
+		return call.entry.ips, call.entry.err
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	r.inflight[name] = call
+	r.mu.Unlock()
+
+	start := time.Now()
+	entry := r.resolve(name)
+	latency := time.Since(start)
+
+	r.mu.Lock()
+	r.stats.Queries++
+	r.stats.TotalLatency += latency
+	r.stats.LastLatency = latency
+	if entry.err != nil && !isNotFound(entry.err) {
+		r.stats.Failures++
+	}
+	// Ошибки связи с серверами не кэшируются, в отличие от отрицательных ответов
+	if !entry.expires.IsZero() {
+		r.cache[name] = entry
+	}
+	delete(r.inflight, name)
+	r.mu.Unlock()
+
+	call.entry = entry
+	close(call.done)
+
+	if entry.err != nil {
+		r.logf("Resolving %s failed in %s: %v", name, latency, entry.err)
+	} else {
+		r.logf("Resolved %s to %v in %s", name, entry.ips, latency)
+	}
+	return entry.ips, entry.err
+}
+
+// logf запись в журнал резолвера
+func (r *Resolver) logf(format string, v ...any) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Stats копия текущей статистики резолвера
+func (r *Resolver) Stats() ResolverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// resolve запрос записей A и AAAA у DNS-серверов
+func (r *Resolver) resolve(name string) *dnsCacheEntry {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	results := make([]result, 2)
+	var wg sync.WaitGroup
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, ttl, err := r.query(name, qtype)
+			results[i] = result{ips, ttl, err}
+		}()
+	}
+	wg.Wait()
+
+	entry := &dnsCacheEntry{}
+	ttl := dnsMaxTTL
+	negative := true
+	for _, res := range results {
+		if res.err != nil && !isNotFound(res.err) {
+			entry.err = res.err
+			negative = false
+			continue
+		}
+		entry.ips = append(entry.ips, res.ips...)
+		ttl = min(ttl, res.ttl)
+	}
+
+	switch {
+	case len(entry.ips) > 0:
+		entry.err = nil
+	case negative:
+		entry.err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return entry // ошибка связи, в кэш не попадает
+	}
+
+	entry.expires = time.Now().Add(ttl)
+	return entry
+}
+
+// isNotFound является ли ошибка отрицательным ответом DNS
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// query запрос записей одного типа с перебором серверов.
+// Возвращает адреса и время, на которое результат можно кэшировать
+func (r *Resolver) query(name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	fqdn, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid domain name", Name: name, IsNotFound: true}
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: fqdn, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range r.servers {
+		var resp []byte
+		if !r.useTCP {
+			resp, err = r.exchange("udp", server, packed)
+			if err == nil && isTruncated(resp) {
+				resp, err = r.exchange("tcp", server, packed)
+			}
+		} else {
+			resp, err = r.exchange("tcp", server, packed)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ips, ttl, err := parseResponse(resp, id, name, qtype)
+		if err != nil {
+			lastErr = err
+			if isNotFound(err) {
+				return nil, ttl, err
+			}
+			continue
+		}
+		return ips, ttl, nil
+	}
+
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+// exchange отправка запроса серверу и получение ответа
+func (r *Resolver) exchange(network, server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(r.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "udp" {
+		_, err = conn.Write(query)
+		if err != nil {
+			return nil, err
+		}
+		resp := make([]byte, dnsUDPSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	// По TCP сообщение предваряется двухбайтовой длиной
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	_, err = conn.Write(append(msg, query...))
+	if err != nil {
+		return nil, err
+	}
+	lenBuf := make([]byte, 2)
+	_, err = io.ReadFull(conn, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// isTruncated установлен ли в ответе флаг усечения
+func isTruncated(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.Truncated
+}
+
+// parseResponse разбор ответа сервера.
+// Для отрицательного ответа время кэширования берётся из записи SOA (RFC 2308)
+func parseResponse(resp []byte, id uint16, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("mismatched DNS response")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("DNS server returned %s", h.RCode)
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	ttl := dnsMaxTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch {
+		case rh.Type == qtype && rh.Type == dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.A[:]))
+		case rh.Type == qtype && rh.Type == dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(res.AAAA[:]))
+		default:
+			// CNAME и прочие записи цепочки учитываются только через TTL
+			err = p.SkipAnswer()
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		ttl = min(ttl, time.Duration(rh.TTL)*time.Second)
+	}
+
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	negativeTTL := dnsNegativeTTL
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			if p.SkipAuthority() != nil {
+				break
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		negativeTTL = min(time.Duration(rh.TTL), time.Duration(soa.MinTTL)) * time.Second
+		break
+	}
+
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
@@ -0,0 +1,314 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer ответ заглушки DNS-сервера на один вопрос
+type stubAnswer struct {
+	ips      []net.IP
+	ttl      uint32
+	nxdomain bool
+	soaTTL   uint32 // TTL записи SOA в ответе без адресов, 0 - без SOA
+	soaMin   uint32 // поле MINIMUM записи SOA
+	truncate bool   // ответ по UDP с флагом TC и без записей
+}
+
+// stubDNS DNS-сервер на 127.0.0.1, отвечающий по UDP и TCP на одном порту
+type stubDNS struct {
+	addr string
+	udp  *net.UDPConn
+	tcp  *net.TCPListener
+	// answer ответ на вопрос; tcp - запрос пришёл по TCP
+	answer func(q dnsmessage.Question, tcp bool) stubAnswer
+
+	udpQueries atomic.Int64
+	tcpQueries atomic.Int64
+}
+
+func newStubDNS(t *testing.T, answer func(q dnsmessage.Question, tcp bool) stubAnswer) *stubDNS {
+	t.Helper()
+
+	s := &stubDNS{answer: answer}
+	// Порт UDP может оказаться занят для TCP, тогда пробуем другой
+	for attempt := 0; ; attempt++ {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.LocalAddr().(*net.UDPAddr).Port})
+		if err != nil {
+			udp.Close()
+			if attempt < 10 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		s.udp, s.tcp = udp, tcp
+		break
+	}
+	s.addr = s.udp.LocalAddr().String()
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubDNS) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.udpQueries.Add(1)
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.respond(query, false); resp != nil {
+				_, _ = s.udp.WriteToUDP(resp, from)
+			}
+		}()
+	}
+}
+
+func (s *stubDNS) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.tcpQueries.Add(1)
+		go func() {
+			defer conn.Close()
+			lenBuf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, lenBuf); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(lenBuf))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			if resp := s.respond(query, true); resp != nil {
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}
+		}()
+	}
+}
+
+// respond ответ на запрос query в формате DNS, nil - запрос не разобран
+func (s *stubDNS) respond(query []byte, tcp bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil || len(req.Questions) != 1 {
+		return nil
+	}
+
+	q := req.Questions[0]
+	ans := s.answer(q, tcp)
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.ID, Response: true, RecursionAvailable: true},
+		Questions: req.Questions,
+	}
+	if ans.nxdomain {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	if ans.truncate && !tcp {
+		resp.Truncated = true
+		packed, _ := resp.Pack()
+		return packed
+	}
+
+	for _, ip := range ans.ips {
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ans.ttl}
+		switch {
+		case ip.To4() != nil && q.Type == dnsmessage.TypeA:
+			hdr.Type = dnsmessage.TypeA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte(ip.To4())}})
+		case ip.To4() == nil && q.Type == dnsmessage.TypeAAAA:
+			hdr.Type = dnsmessage.TypeAAAA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	}
+	if len(resp.Answers) == 0 && ans.soaTTL > 0 {
+		zone := dnsmessage.MustNewName("example.test.")
+		resp.Authorities = append(resp.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ans.soaTTL},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example.test."),
+				MBox:   dnsmessage.MustNewName("hostmaster.example.test."),
+				MinTTL: ans.soaMin,
+			},
+		})
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// queries общее число запросов к заглушке
+func (s *stubDNS) queries() int64 {
+	return s.udpQueries.Load() + s.tcpQueries.Load()
+}
+
+func newTestResolver(t *testing.T, server string) *Resolver {
+	t.Helper()
+
+	r, err := NewResolver([]string{server}, false, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Logger = log.New(io.Discard, "", 0)
+	return r
+}
+
+func TestResolverCacheExpiresAfterTTL(t *testing.T) {
+	stub := newStubDNS(t, func(q dnsmessage.Question, tcp bool) stubAnswer {
+		return stubAnswer{ips: []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}, ttl: 1, soaTTL: 60, soaMin: 60}
+	})
+	r := newTestResolver(t, stub.addr)
+
+	ips, err := r.LookupIPs("host.example.test")
+	if err != nil {
+		t.Fatalf("first lookup: %v", err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("got %v, want A and AAAA addresses", ips)
+	}
+
+	if _, err := r.LookupIPs("HOST.example.test."); err != nil {
+		t.Fatalf("cached lookup: %v", err)
+	}
+	if got := stub.queries(); got != 2 {
+		t.Fatalf("server got %d queries before TTL expiry, want 2 (A and AAAA)", got)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := r.LookupIPs("host.example.test"); err != nil {
+		t.Fatalf("lookup after TTL expiry: %v", err)
+	}
+	if got := stub.queries(); got != 4 {
+		t.Fatalf("server got %d queries after TTL expiry, want 4", got)
+	}
+
+	stats := r.Stats()
+	if stats.Lookups != 3 || stats.CacheHits != 1 || stats.Queries != 2 {
+		t.Fatalf("stats = %+v, want 3 lookups, 1 cache hit, 2 queries", stats)
+	}
+	if stats.TotalLatency <= 0 {
+		t.Fatalf("TotalLatency = %v, want positive", stats.TotalLatency)
+	}
+}
+
+func TestResolverNegativeCacheUsesSOA(t *testing.T) {
+	stub := newStubDNS(t, func(q dnsmessage.Question, tcp bool) stubAnswer {
+		return stubAnswer{nxdomain: true, soaTTL: 300, soaMin: 5}
+	})
+	r := newTestResolver(t, stub.addr)
+
+	before := time.Now()
+	_, err := r.LookupIPs("missing.example.test")
+	if !isNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+
+	// Время кэширования - меньшее из TTL записи SOA и её поля MINIMUM (RFC 2308)
+	r.mu.Lock()
+	entry := r.cache["missing.example.test"]
+	r.mu.Unlock()
+	if entry == nil {
+		t.Fatal("negative answer is not cached")
+	}
+	if ttl := entry.expires.Sub(before); ttl < 4*time.Second || ttl > 6*time.Second {
+		t.Fatalf("negative answer cached for %v, want about 5s from SOA", ttl)
+	}
+
+	_, err = r.LookupIPs("missing.example.test")
+	if !isNotFound(err) {
+		t.Fatalf("cached lookup: got error %v, want not found", err)
+	}
+	if got := stub.queries(); got != 2 {
+		t.Fatalf("server got %d queries, want 2: the second lookup must come from the cache", got)
+	}
+	if stats := r.Stats(); stats.Failures != 0 {
+		t.Fatalf("negative answer counted as %d failure(s)", stats.Failures)
+	}
+}
+
+func TestResolverTruncatedFallsBackToTCP(t *testing.T) {
+	stub := newStubDNS(t, func(q dnsmessage.Question, tcp bool) stubAnswer {
+		return stubAnswer{ips: []net.IP{net.IPv4(192, 0, 2, 7)}, ttl: 60, soaTTL: 60, soaMin: 60, truncate: true}
+	})
+	r := newTestResolver(t, stub.addr)
+
+	ips, err := r.LookupIPs("big.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Fatalf("got %v, want 192.0.2.7 from the TCP answer", ips)
+	}
+	if stub.udpQueries.Load() != 2 || stub.tcpQueries.Load() != 2 {
+		t.Fatalf("got %d UDP and %d TCP queries, want each query retried over TCP",
+			stub.udpQueries.Load(), stub.tcpQueries.Load())
+	}
+}
+
+func TestResolverDeduplicatesInflightLookups(t *testing.T) {
+	stub := newStubDNS(t, func(q dnsmessage.Question, tcp bool) stubAnswer {
+		time.Sleep(200 * time.Millisecond) // остальные запросы успевают присоединиться к первому
+		return stubAnswer{ips: []net.IP{net.IPv4(192, 0, 2, 9)}, ttl: 60, soaTTL: 60, soaMin: 60}
+	})
+	r := newTestResolver(t, stub.addr)
+
+	const lookups = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, lookups)
+	for range lookups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.LookupIPs("slow.example.test")
+			if err == nil && (len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 9))) {
+				t.Errorf("got %v, want 192.0.2.9", ips)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := stub.queries(); got != 2 {
+		t.Fatalf("server got %d queries for %d concurrent lookups, want 2 (A and AAAA)", got, lookups)
+	}
+	if stats := r.Stats(); stats.Queries != 1 {
+		t.Fatalf("stats.Queries = %d, want 1", stats.Queries)
+	}
+}
+
+func TestNewResolverRejectsNonPositiveTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		if _, err := NewResolver([]string{"127.0.0.1"}, false, timeout); err == nil {
+			t.Errorf("NewResolver with timeout %v succeeded, want error", timeout)
+		}
+	}
+}
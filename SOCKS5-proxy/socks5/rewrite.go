@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// rewriteRule подмена адреса назначения
+type rewriteRule struct {
+	line int    // номер строки в файле подмен
+	text string // исходный текст для журнала
+
+	host string     // шаблон имени как в правилах доступа, пусто для подсети
+	nets *net.IPNet // подсеть назначения
+	port int        // порт назначения, 0 - любой
+
+	target     string // имя или IP-адрес, на который выполняется подмена
+	targetPort int    // порт подмены, 0 - исходный порт
+}
+
+// RewriteTable таблица подмены адресов назначения CONNECT, применяется первая совпавшая
+type RewriteTable struct {
+	rules []*rewriteRule
+}
+
+// LoadRewrites чтение файла подмен.
+// Формат строки: "pattern[:port] target[:port]", где pattern - шаблон имени как
+// в правилах доступа, IP или CIDR (IPv6 с портом - в квадратных скобках).
+// Без порта или с портом "*" в pattern подменяется любой порт, в target - порт сохраняется;
+// пустые строки и строки с '#' пропускаются
+func LoadRewrites(filename string) (*RewriteTable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseRewrites(strings.Split(string(data), "\n"), filename+":")
+}
+
+// ParseRewrites разбор подмен того же формата, что и в файле, из списка строк.
+// Номером строки считается позиция в списке
+func ParseRewrites(lines []string) (*RewriteTable, error) {
+	return parseRewrites(lines, "rewrite ")
+}
+
+// parseRewrites разбор строк подмен, prefix предваряет номер строки в ошибках
+func parseRewrites(lines []string, prefix string) (*RewriteTable, error) {
+	rt := &RewriteTable{}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRewrite(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s%d: %v", prefix, i+1, err)
+		}
+		rule.line = i + 1
+		rt.rules = append(rt.rules, rule)
+	}
+	return rt, nil
+}
+
+// parseRewrite разбор одной подмены
+func parseRewrite(text string) (*rewriteRule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return nil, errors.New("expected \"pattern[:port] target[:port]\"")
+	}
+	rule := &rewriteRule{text: strings.Join(fields, " ")}
+
+	pattern, port, err := splitRewriteAddress(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule.port = port
+	if strings.Contains(pattern, "/") || net.ParseIP(pattern) != nil {
+		rule.nets, err = parseCIDR(pattern)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+		rule.host = strings.ToLower(pattern)
+	}
+
+	rule.target, rule.targetPort, err = splitRewriteAddress(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if rule.target == "" || strings.ContainsAny(rule.target, "*?[/") {
+		return nil, fmt.Errorf("invalid target %q", fields[1])
+	}
+	return rule, nil
+}
+
+// splitRewriteAddress разделение "host[:port]" на имя и порт (0 - порт не указан)
+func splitRewriteAddress(s string) (string, int, error) {
+	host, portStr := s, ""
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		var err error
+		host, portStr, err = net.SplitHostPort(s)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	if portStr == "" || portStr == "*" {
+		return host, 0, nil
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", s)
+	}
+	return host, port, nil
+}
+
+// Len количество подмен
+func (rt *RewriteTable) Len() int {
+	return len(rt.rules)
+}
+
+// rewrite адрес, на который подменяется address, и сработавшая подмена;
+// nil - подмены нет
+func (rt *RewriteTable) rewrite(address string) (string, *rewriteRule) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+
+	for _, r := range rt.rules {
+		if r.port != 0 && r.port != port {
+			continue
+		}
+		if r.nets != nil && (ip == nil || !r.nets.Contains(ip)) {
+			continue
+		}
+		if r.host != "" && (ip != nil || !matchHost(r.host, host)) {
+			continue
+		}
+
+		if r.targetPort != 0 {
+			port = r.targetPort
+		}
+		return net.JoinHostPort(r.target, strconv.Itoa(port)), r
+	}
+	return address, nil
+}
+
+// rewriteDestination подмена адреса назначения CONNECT по таблице Rewrites
+func (s *Server) rewriteDestination(address string) string {
+	if s.Rewrites == nil {
+		return address
+	}
+	rewritten, rule := s.Rewrites.rewrite(address)
+	if rule != nil {
+		s.logf("Rewriting %s -> %s (rewrite at line %d: %s)", address, rewritten, rule.line, rule.text)
+	}
+	return rewritten
+}
@@ -0,0 +1,259 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Способы обслуживания соединений
+const (
+	EngineGoroutine = "goroutine" // горутина на каждое соединение
+	EngineEpoll     = "epoll"     // событийные циклы epoll, только Linux
+)
+
+// ErrServerClosed Serve завершился из-за вызова Shutdown или Close
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// Logger журнал событий сервера, подходит *log.Logger
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Server SOCKS5-прокси. Поля настраиваются до первого вызова Serve, дальше
+// правила и методы аутентификации меняются через SetRules и SetAuthenticators.
+// Нулевое значение - прокси без аутентификации и ограничений
+type Server struct {
+	// Authenticators методы аутентификации в порядке предпочтения сервера,
+	// пустой список - только без аутентификации
+	Authenticators []Authenticator
+	// Dialer подключение к целевым адресам, nil - напрямую
+	Dialer Dialer
+	// Rules правила доступа, nil - разрешено всё
+	Rules *RuleSet
+	// Logger журнал событий, nil - стандартный журнал пакета log
+	Logger Logger
+	// Resolver резолвер доменных имён, nil - системный
+	Resolver *Resolver
+	// AccessLog журнал доступа, nil - отключён
+	AccessLog *AccessLog
+	// Rewrites подмена адресов назначения CONNECT, nil - без подмены.
+	// Правила доступа проверяются по исходному адресу из запроса
+	Rewrites *RewriteTable
+	// TLSConfig настройки TLS для ServeTLS
+	TLSConfig *tls.Config
+	// Egress исходящие адреса подключений к целям, nil - выбирает ядро
+	Egress *EgressPool
+	// UserEgress исходящие адреса по имени пользователя, важнее настроек листенера
+	UserEgress map[string]*EgressPool
+
+	Timeouts  Timeouts        // ограничения времени, нулевые - без ограничений
+	Bandwidth RateLimits      // ограничения скорости
+	Limits    AdmissionLimits // ограничения на приём соединений
+
+	// Engine EngineGoroutine (по умолчанию) или EngineEpoll.
+	// TLS-соединения при любом движке обслуживаются горутинами
+	Engine     string
+	EpollLoops int // количество событийных циклов, 0 - по числу процессоров
+
+	setupOnce  sync.Once
+	started    time.Time
+	rules      atomic.Pointer[RuleSet]
+	auths      atomic.Pointer[[]Authenticator]
+	registry   *sessionRegistry
+	metrics    *proxyMetrics
+	admission  *admissionControl
+	buckets    *bandwidthBuckets
+	sessionIDs atomic.Uint64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	loops     []*epollLoop
+	closed    bool
+}
+
+// setup создание внутреннего состояния при первом использовании
+func (s *Server) setup() {
+	s.started = time.Now()
+	s.rules.Store(s.Rules)
+	auths := s.Authenticators
+	s.auths.Store(&auths)
+	s.registry = newSessionRegistry()
+	s.metrics = newProxyMetrics()
+	s.admission = newAdmissionControl(s.Limits)
+	s.buckets = newBandwidthBuckets(s.Bandwidth)
+	s.listeners = make(map[net.Listener]struct{})
+}
+
+// SetRules замена правил доступа, nil - разрешено всё. Действует на новые
+// запросы и датаграммы UDP, установленные туннели не затрагиваются
+func (s *Server) SetRules(rules *RuleSet) {
+	s.setupOnce.Do(s.setup)
+	s.rules.Store(rules)
+}
+
+// SetAuthenticators замена методов аутентификации. Действует на новые
+// соединения, уже аутентифицированные сессии продолжают работу
+func (s *Server) SetAuthenticators(auths []Authenticator) {
+	s.setupOnce.Do(s.setup)
+	s.auths.Store(&auths)
+}
+
+// logf запись в журнал сервера
+func (s *Server) logf(format string, v ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// dialer подключение к целевым адресам с учётом резолвера
+func (s *Server) dialer() Dialer {
+	if s.Dialer != nil {
+		return s.Dialer
+	}
+	return DirectDialer{Resolver: s.Resolver}
+}
+
+// Serve приём соединений из listener до его закрытия.
+// После Shutdown или Close возвращает ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	return s.ServeWithPolicy(listener, nil)
+}
+
+// ServeWithPolicy приём соединений из listener с настройками policy (nil - настройки
+// сервера). Листенеров может быть несколько, каждый обслуживается своим вызовом
+func (s *Server) ServeWithPolicy(listener net.Listener, policy *ListenerPolicy) error {
+	s.setupOnce.Do(s.setup)
+
+	if policy != nil && policy.TLSConfig != nil {
+		listener = tls.NewListener(listener, policy.TLSConfig)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+	}()
+
+	var err error
+	switch s.Engine {
+	case "", EngineGoroutine:
+		err = s.serveGoroutines(listener, policy)
+	case EngineEpoll:
+		loops := s.EpollLoops
+		if loops <= 0 {
+			loops = runtime.NumCPU()
+		}
+		err = s.serveEpoll(listener, loops, policy)
+	default:
+		return fmt.Errorf("unknown engine: %s", s.Engine)
+	}
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// serveGoroutines приём соединений с обработкой каждого в отдельной горутине.
+// Завершается при закрытии listener
+func (s *Server) serveGoroutines(listener net.Listener, policy *ListenerPolicy) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			s.logf("Error accepting connection: %v", err)
+			continue
+		}
+
+		if !s.admit(conn) {
+			continue
+		}
+		go s.handleClient(conn, policy)
+	}
+}
+
+// closeListeners прекращение приёма новых соединений
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// stopLoops остановка событийных циклов после закрытия всех сессий
+func (s *Server) stopLoops() {
+	s.mu.Lock()
+	loops := s.loops
+	s.loops = nil
+	s.mu.Unlock()
+
+	for _, l := range loops {
+		l.stop()
+	}
+}
+
+// Shutdown корректное завершение: прекращение приёма соединений и ожидание
+// активных сессий, пока не завершится ctx. Оставшиеся сессии закрываются
+// принудительно, в этом случае возвращается ошибка ctx
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.setupOnce.Do(s.setup)
+	start := time.Now()
+	s.closeListeners()
+
+	active, _ := s.registry.count()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.logf("Shutting down: waiting up to %s for %d active session(s)", time.Until(deadline).Round(time.Millisecond), active)
+	} else {
+		s.logf("Shutting down: waiting for %d active session(s)", active)
+	}
+
+	forced := 0
+	err := s.registry.wait(ctx)
+	if err != nil {
+		forced = s.registry.closeAll()
+		waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = s.registry.wait(waitCtx)
+		cancel()
+	}
+	s.stopLoops()
+
+	_, total := s.registry.count()
+	s.logf("Shutdown complete in %s: %d session(s) finished gracefully, %d force-closed, %d served in total",
+		time.Since(start).Round(time.Millisecond), max(active-forced, 0), forced, total)
+	return err
+}
+
+// Close немедленное закрытие слушающих сокетов и всех сессий
+func (s *Server) Close() error {
+	s.setupOnce.Do(s.setup)
+	s.closeListeners()
+	s.registry.closeAll()
+	s.stopLoops()
+	return nil
+}
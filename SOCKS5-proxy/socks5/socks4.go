@@ -0,0 +1,189 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Socks4Version = 0x04
+
+	Socks4Granted  = 0x5A // запрос выполнен
+	Socks4Rejected = 0x5B // запрос отклонён или не выполнен
+
+	socks4MaxField = 255 // предел длины USERID и доменного имени SOCKS4a
+)
+
+var (
+	// errSocks4Field поле USERID или доменное имя длиннее допустимого
+	errSocks4Field = errors.New("SOCKS4 field is too long")
+	// errSocks4EmptyHost пустое доменное имя SOCKS4a
+	errSocks4EmptyHost = errors.New("empty SOCKS4a domain name")
+)
+
+// anonymousAllowed обслуживаются ли клиенты без учётных данных. SOCKS4 не
+// передаёт пароль, поэтому допустим, только если это так
+func (s *Server) anonymousAllowed() bool {
+	return s.selectAuthenticator([]byte{NoAuth}) != nil
+}
+
+// readSOCKS4Request чтение запроса SOCKS4/SOCKS4a после байта версии.
+// Возвращает команду и целевой адрес в виде "host:port"
+func (s *Server) readSOCKS4Request(sess *session) (byte, string, bool) {
+	conn := sess.conn
+
+	/*
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+		+----+----+----+----+----+----+----+----+----+----+....+----+
+		  1    1      2              4           variable       1
+	*/
+
+	cmd, address, userID, err := readSOCKS4(conn)
+	if err != nil {
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(socks4Failure(err))
+		return 0, "", false
+	}
+
+	if sess.identity == "" && !s.anonymousAllowed() {
+		connectedSend(sess, NotAllowed)
+		s.logf("Rejecting SOCKS4 request from %s: authentication is required", conn.RemoteAddr().String())
+		s.metrics.handshakeFailed(failNoAcceptableAuth)
+		return 0, "", false
+	}
+
+	if cmd != TCP && cmd != Bind {
+		connectedSend(sess, NotSupportedCommand)
+		s.logf("Unknown SOCKS4 command: %x", cmd)
+		s.metrics.handshakeFailed(failBadCommand)
+		return 0, "", false
+	}
+
+	if userID != "" {
+		s.logf("SOCKS4 request from %s (userid %q)", conn.RemoteAddr().String(), userID)
+	} else {
+		s.logf("SOCKS4 request from %s", conn.RemoteAddr().String())
+	}
+	return cmd, address, true
+}
+
+// readSOCKS4 чтение запроса SOCKS4/SOCKS4a из потока после байта версии.
+// Запрос читается по байту до его конца, чтобы данные клиента за ним остались
+// в сокете, и разбирается тем же parseSOCKS4Request, что и в событийном цикле
+func readSOCKS4(r io.Reader) (cmd byte, address, userID string, err error) {
+	buf := make([]byte, 8, 64)
+	buf[0] = Socks4Version
+	_, err = io.ReadFull(r, buf[1:]) // CD, DSTPORT, DSTIP
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	b := make([]byte, 1)
+	for {
+		var n int
+		cmd, address, userID, n, err = parseSOCKS4Request(buf)
+		if err != nil || n > 0 {
+			return cmd, address, userID, err
+		}
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return 0, "", "", err
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// parseSOCKS4Request разбор запроса SOCKS4/SOCKS4a целиком из буфера b, начиная с VN.
+// Возвращает команду, целевой адрес, USERID и количество занятых запросом байт;
+// n == 0 без ошибки означает, что запрос получен не полностью
+func parseSOCKS4Request(b []byte) (cmd byte, address, userID string, n int, err error) {
+	if len(b) < 8 {
+		return 0, "", "", 0, nil
+	}
+	end := bytes.IndexByte(b[8:], 0)
+	if end < 0 {
+		if len(b)-8 > socks4MaxField {
+			return 0, "", "", 0, errSocks4Field
+		}
+		return 0, "", "", 0, nil
+	}
+	if end > socks4MaxField {
+		return 0, "", "", 0, errSocks4Field
+	}
+	userID = string(b[8 : 8+end])
+	n = 8 + end + 1
+
+	// SOCKS4a: DSTIP 0.0.0.x (x != 0) означает, что за USERID следует имя узла
+	host := net.IP(b[4:8]).String()
+	if isSOCKS4aAddr(b[4:8]) {
+		end = bytes.IndexByte(b[n:], 0)
+		if end < 0 {
+			if len(b)-n > socks4MaxField {
+				return 0, "", "", 0, errSocks4Field
+			}
+			return 0, "", "", 0, nil
+		}
+		if end == 0 {
+			return 0, "", "", 0, errSocks4EmptyHost
+		}
+		if end > socks4MaxField {
+			return 0, "", "", 0, errSocks4Field
+		}
+		host = string(b[n : n+end])
+		n += end + 1
+	}
+
+	port := binary.BigEndian.Uint16(b[2:4])
+	return b[1], net.JoinHostPort(host, strconv.Itoa(int(port))), userID, n, nil
+}
+
+// isSOCKS4aAddr является ли DSTIP признаком SOCKS4a (0.0.0.x, x != 0)
+func isSOCKS4aAddr(ip []byte) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+// socks4Failure причина неудачного рукопожатия SOCKS4 для метрик
+func socks4Failure(err error) string {
+	if errors.Is(err, errSocks4Field) {
+		return failTooLong
+	}
+	return readFailure(err)
+}
+
+// socks4Reply ответ SOCKS4 по коду ответа SOCKS5: успех передаётся как
+// "запрос выполнен", любая ошибка - как "запрос отклонён". DSTIP адреса
+// addr, отличного от IPv4, передаётся нулями: клиент использует адрес прокси
+func socks4Reply(rep byte, addr net.Addr) []byte {
+	/*
+		+----+----+----+----+----+----+----+----+
+		| VN | CD | DSTPORT |      DSTIP        |
+		+----+----+----+----+----+----+----+----+
+		  1    1      2              4
+	*/
+
+	cd := byte(Socks4Granted)
+	if rep != Succeeded {
+		cd = Socks4Rejected
+	}
+	reply := make([]byte, 8)
+	reply[1] = cd
+
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	binary.BigEndian.PutUint16(reply[2:4], uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(reply[4:8], ip4)
+	}
+	return reply
+}
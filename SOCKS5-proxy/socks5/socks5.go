@@ -0,0 +1,601 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SocksVersion = 0x05
+	TCP          = 0x01
+	Bind         = 0x02
+	UDPAssociate = 0x03
+	IPv4         = 0x01
+	DomainName   = 0x03
+	IPv6         = 0x04
+	Null         = 0x00
+
+	NoAuth           = 0x00
+	UserPass         = 0x02
+	NoAcceptableAuth = 0xFF
+
+	Succeeded               = 0x00
+	Failed                  = 0x01
+	NotAllowed              = 0x02
+	NetworkUnreachable      = 0x03
+	HostUnreachable         = 0x04
+	ConnectionRefused       = 0x05
+	TTLExpired              = 0x06
+	NotSupportedCommand     = 0x07
+	NotSupportedAddressType = 0x08
+)
+
+// session состояние одного клиентского соединения
+type session struct {
+	sessionInfo
+	srv  *Server
+	conn net.Conn
+
+	identity string // субъект проверенного клиентского сертификата TLS
+
+	mu      sync.Mutex
+	closers []io.Closer // ресурсы сессии: соединение с удалённым узлом, сокеты релея
+	forced  bool        // сессия закрыта принудительно
+}
+
+// handshake определение протокола по первому байту и чтение запроса клиента.
+// Возвращает команду и целевой адрес в виде "host:port"
+func (s *Server) handshake(sess *session) (byte, string, bool) {
+	conn := sess.conn
+	buf := make([]byte, 1) // версия прокси или первый байт HTTP-запроса
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return 0, "", false
+	}
+
+	switch {
+	case buf[0] == SocksVersion:
+		sess.setVersion(SocksVersion)
+		if s.connectToClient(sess) {
+			s.logf("Connection to client failed")
+			return 0, "", false
+		}
+		return s.readRequest(sess)
+	case buf[0] == Socks4Version:
+		sess.setVersion(Socks4Version)
+		return s.readSOCKS4Request(sess)
+	case isHTTPStart(buf[0]):
+		sess.setVersion(HTTPVersion)
+		return s.readHTTPRequest(sess, buf[0])
+	default:
+		s.logf("Accepting ONLY SOCKS4, SOCKS5 and HTTP CONNECT connections, got: %x", buf[0])
+		s.metrics.handshakeFailed(failBadVersion)
+		return 0, "", false
+	}
+}
+
+// connectToClient подключение к клиенту SOCKS5 после байта версии
+func (s *Server) connectToClient(sess *session) bool {
+	conn := sess.conn
+	buf := make([]byte, 1) // количество методов аутентификации
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return true
+	}
+
+	numMethods := int(buf[0])
+	methods := make([]byte, numMethods)
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return true
+	}
+
+	auth := s.selectSessionAuthenticator(sess, methods)
+	if auth == nil {
+		_, _ = conn.Write([]byte{SocksVersion, NoAcceptableAuth})
+		s.logf("No acceptable auth methods from %s, offered: %x", conn.RemoteAddr().String(), methods)
+		s.metrics.handshakeFailed(failNoAcceptableAuth)
+		return true
+	}
+
+	return !s.authenticate(sess, auth)
+}
+
+// authenticate сообщение клиенту выбранного метода и под-согласование по нему.
+// Возвращает false, если аутентификация не пройдена
+func (s *Server) authenticate(sess *session, auth Authenticator) bool {
+	conn := sess.conn
+	_, err := conn.Write([]byte{SocksVersion, auth.Method()})
+	if err != nil {
+		s.logf("Error writing to %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return false
+	}
+
+	user, err := auth.Authenticate(conn)
+	if err != nil {
+		s.logf("Authentication of %s failed: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(failAuth)
+		return false
+	}
+	if user != "" {
+		sess.setUser(user)
+	}
+
+	if sess.user != "" {
+		s.logf("Successful connection with client %s (user %q)", conn.RemoteAddr().String(), sess.user)
+	} else {
+		s.logf("Successful connection with client %s", conn.RemoteAddr().String())
+	}
+	return true
+}
+
+// readRequest чтение запроса клиента.
+// Возвращает команду и целевой адрес в виде "host:port"
+func (s *Server) readRequest(sess *session) (byte, string, bool) {
+	conn := sess.conn
+
+	/*
+		+----+-----+-------+------+----------+----------+
+		|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+		+----+-----+-------+------+----------+----------+
+		| 1  |  1  | X'00' |  1   | Variable |    2     |
+		+----+-----+-------+------+----------+----------+
+	*/
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		connectedSend(sess, Failed)
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return 0, "", false
+	}
+
+	// Проверяем версию прокси
+	if buf[0] != SocksVersion {
+		connectedSend(sess, NotSupportedCommand)
+		s.logf("Accepting ONLY SOCKS5 connections, got: %x", buf[0])
+		s.metrics.handshakeFailed(failBadVersion)
+		return 0, "", false
+	}
+
+	// Проверяем тип соединения
+	if buf[1] != TCP && buf[1] != Bind && buf[1] != UDPAssociate {
+		connectedSend(sess, NotSupportedCommand)
+		s.logf("Unknown command: %x", buf[1])
+		s.metrics.handshakeFailed(failBadCommand)
+		return 0, "", false
+	}
+
+	var address string
+
+	// Определяем целевой адрес
+	switch buf[3] {
+
+	case IPv4:
+		tmpAddr := make([]byte, 4)
+		_, err := io.ReadFull(conn, tmpAddr)
+		if err != nil {
+			connectedSend(sess, Failed)
+			s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+			s.metrics.handshakeFailed(readFailure(err))
+			return 0, "", false
+		}
+		address = net.IP(tmpAddr).String()
+
+	case IPv6:
+		tmpAddr := make([]byte, net.IPv6len)
+		_, err := io.ReadFull(conn, tmpAddr)
+		if err != nil {
+			connectedSend(sess, Failed)
+			s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+			s.metrics.handshakeFailed(readFailure(err))
+			return 0, "", false
+		}
+		address = net.IP(tmpAddr).String()
+
+	case DomainName:
+		lenBuf := make([]byte, 1)
+		_, err := io.ReadFull(conn, lenBuf) // считываем размер доменного имени
+		if err != nil {
+			connectedSend(sess, Failed)
+			s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+			s.metrics.handshakeFailed(readFailure(err))
+			return 0, "", false
+		}
+		if lenBuf[0] == 0 {
+			connectedSend(sess, Failed)
+			s.logf("Rejecting request from %s: %v", conn.RemoteAddr().String(), errEmptyDomain)
+			s.metrics.handshakeFailed(failBadAddressType)
+			return 0, "", false
+		}
+		domain := make([]byte, lenBuf[0])
+		_, err = io.ReadFull(conn, domain)
+		if err != nil {
+			connectedSend(sess, Failed)
+			s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+			s.metrics.handshakeFailed(readFailure(err))
+			return 0, "", false
+		}
+		address = string(domain)
+
+	default:
+		connectedSend(sess, NotSupportedAddressType)
+		s.logf("Unsupported SOCKS5 address type: %x", buf[3])
+		s.metrics.handshakeFailed(failBadAddressType)
+		return 0, "", false
+	}
+
+	portBuf := make([]byte, 2)
+	_, err = io.ReadFull(conn, portBuf)
+	if err != nil {
+		connectedSend(sess, Failed)
+		s.logf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(readFailure(err))
+		return 0, "", false
+	}
+
+	port := binary.BigEndian.Uint16(portBuf)
+	return buf[1], net.JoinHostPort(address, strconv.Itoa(int(port))), true
+}
+
+// connectToRemote подключение к удалённому серверу
+func (s *Server) connectToRemote(sess *session, address string) net.Conn {
+	conn := sess.conn
+
+	targetConn, via, err := s.dialAllowed(conn.RemoteAddr(), sess.user, sess.policy, address)
+	if err != nil {
+		rep := dialErrorReply(err)
+		s.logf("Error connecting to %s (reply %x): %v", address, rep, err)
+		connectedSend(sess, rep)
+		return nil
+	}
+
+	sess.track(targetConn)
+	sess.setRoute(targetConn.RemoteAddr(), via)
+	sendReply(sess, Succeeded, targetConn.LocalAddr())
+	if sess.user != "" {
+		s.logf("Successfully connected to %s for user %q", address, sess.user)
+	} else {
+		s.logf("Successfully connected to %s", address)
+	}
+	return targetConn
+}
+
+// dialAllowed проверка запроса CONNECT по правилам доступа и подключение к цели
+// с учётом подмены адреса и исходящих адресов сессии
+func (s *Server) dialAllowed(client net.Addr, user string, policy *ListenerPolicy, address string) (net.Conn, string, error) {
+	ruleEgress, checked, err := s.checkAccess(client, user, address)
+	if err != nil {
+		return nil, "", err
+	}
+	target := s.rewriteDestination(address)
+	if target != address {
+		checked = nil // правила проверяли исходный адрес, а не подменённый
+	}
+	return s.dialTarget(target, s.egressFor(ruleEgress, policy, user), checked)
+}
+
+// dialTarget подключение к целевому адресу по маршруту, выбранному для него,
+// с исходящим адресом из пула egress (nil - выбирает ядро). При прямом подключении
+// используются только адреса checked, проверенные правилами доступа (nil - любые).
+// via - цепочка вышестоящих прокси, пусто при прямом подключении
+func (s *Server) dialTarget(address string, egress *EgressPool, checked []string) (conn net.Conn, via string, err error) {
+	dialer := s.dialer()
+	if rt, ok := dialer.(*RouteTable); ok {
+		dialer = rt.DialerFor(address)
+	}
+	if _, ok := dialer.(DirectDialer); !ok {
+		via = fmt.Sprint(dialer)
+		s.logf("Connecting to %s via %s", address, via)
+	}
+	ctx := withChecked(withEgress(context.Background(), egress), address, checked)
+	if s.Timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeouts.Dial)
+		defer cancel()
+	}
+
+	start := time.Now()
+	conn, err = dialer.DialContext(ctx, "tcp", address)
+	_, portStr, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portStr)
+	s.metrics.dialed(port, time.Since(start))
+	if err == nil && egress != nil {
+		s.logf("Connected to %s from %s (egress %v)", address, conn.LocalAddr(), egress)
+	}
+	return conn, via, err
+}
+
+// connectedSend отправка ответа клиенту без адреса (при ошибке)
+func connectedSend(sess *session, err_code byte) {
+	sendReply(sess, err_code, nil)
+}
+
+// sendReply отправка ответа клиенту с адресом BND.ADDR/BND.PORT,
+// при addr == nil передаётся нулевой IPv4-адрес. Клиентам SOCKS4 и HTTP-прокси
+// код ответа передаётся в виде ответа их протокола
+func sendReply(sess *session, rep byte, addr net.Addr) {
+	/*
+				+----+-----+-------+------+----------+----------+
+		        |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+		        +----+-----+-------+------+----------+----------+
+		        | 1  |  1  | X'00' |  1   | Variable |    2     |
+		        +----+-----+-------+------+----------+----------+
+
+		     Where:
+		          o  VER    protocol version: X'05'
+		          o  REP    Reply field:
+		             o  X'00' succeeded
+		             o  X'01' general SOCKS server failure
+		             o  X'02' connection not allowed by ruleset
+		             o  X'03' Network unreachable
+		             o  X'04' Host unreachable
+		             o  X'05' Connection refused
+		             o  X'06' TTL expired
+		             o  X'07' Command not supported
+		             o  X'08' Address type not supported
+		             o  X'09' to X'FF' unassigned
+		          o  RSV    RESERVED
+		          o  ATYP   address type of following address
+	*/
+
+	sess.setReply(rep)
+	sess.srv.metrics.replySent(rep)
+	var reply []byte
+	switch sess.version {
+	case Socks4Version:
+		reply = socks4Reply(rep, addr)
+	case HTTPVersion:
+		reply = httpResponse(httpReplyStatus(rep))
+	default:
+		reply = replyBytes(rep, addr)
+	}
+	_, err := sess.conn.Write(reply)
+	if err != nil {
+		sess.srv.logf("Error writing to %s: %v", sess.conn.RemoteAddr().String(), err)
+		return
+	}
+}
+
+// replyBytes формирование ответа на запрос
+func replyBytes(rep byte, addr net.Addr) []byte {
+	return append([]byte{SocksVersion, rep, 0x00}, encodeAddr(addr)...)
+}
+
+// encodeAddr кодирование адреса в виде ATYP, ADDR, PORT
+func encodeAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		buf = append([]byte{IPv4}, ip4...)
+	} else {
+		buf = append([]byte{IPv6}, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+var (
+	// errShortAddr буфер содержит адрес не полностью
+	errShortAddr = errors.New("truncated address")
+	// errEmptyDomain доменное имя нулевой длины: без узла адрес указывал бы на сам прокси
+	errEmptyDomain = errors.New("empty domain name")
+)
+
+// parseAddr разбор адреса в виде ATYP, ADDR, PORT.
+// Возвращает адрес "host:port" и количество занятых им байт
+func parseAddr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errShortAddr
+	}
+
+	var host string
+	n := 1
+	switch b[0] {
+
+	case IPv4:
+		if len(b) < n+net.IPv4len {
+			return "", 0, errShortAddr
+		}
+		host = net.IP(b[n : n+net.IPv4len]).String()
+		n += net.IPv4len
+
+	case IPv6:
+		if len(b) < n+net.IPv6len {
+			return "", 0, errShortAddr
+		}
+		host = net.IP(b[n : n+net.IPv6len]).String()
+		n += net.IPv6len
+
+	case DomainName:
+		if len(b) < n+1 || len(b) < n+1+int(b[n]) {
+			return "", 0, errShortAddr
+		}
+		if b[n] == 0 {
+			return "", 0, errEmptyDomain
+		}
+		host = string(b[n+1 : n+1+int(b[n])])
+		n += 1 + int(b[n])
+
+	default:
+		return "", 0, fmt.Errorf("unsupported address type: %x", b[0])
+	}
+
+	if len(b) < n+2 {
+		return "", 0, errShortAddr
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	n += 2
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n, nil
+}
+
+// transferData отправка данных от клиента к удалённому серверу и обратно.
+// Переданные байты учитываются в bytes по направлениям
+func (s *Server) transferData(conn net.Conn, target_conn net.Conn, bytes *[2]atomic.Int64, limit *sessionLimiter) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	idle := newIdleTracker(s.Timeouts)
+	count := func(dir int) func(int64) {
+		return func(n int64) {
+			bytes[dir].Add(n)
+			s.metrics.relayed(dir, n)
+		}
+	}
+	closeIdle := func() {
+		s.logf("Closing idle tunnel %s <-> %s", conn.RemoteAddr().String(), target_conn.RemoteAddr().String())
+		conn.Close()
+		target_conn.Close()
+	}
+
+	go func() { // от клиента к серверу
+		defer wg.Done()
+		defer closeWrite(target_conn)
+
+		_, err := idle.copy(target_conn, conn, directionUp, limit, count(directionUp))
+		if errors.Is(err, errIdleTimeout) {
+			closeIdle()
+		} else if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logf("Error transferring data from %s: %v", conn.RemoteAddr().String(), err)
+		}
+	}()
+
+	go func() { // от сервера к клиенту
+		defer wg.Done()
+		defer closeWrite(conn)
+
+		_, err := idle.copy(conn, target_conn, directionDown, limit, count(directionDown))
+		if errors.Is(err, errIdleTimeout) {
+			closeIdle()
+		} else if err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logf("Error transferring data to %s: %v", conn.RemoteAddr().String(), err)
+		}
+	}()
+
+	wg.Wait()
+}
+
+// closeWriter соединение с закрытием передачи в одну сторону:
+// *net.TCPConn, *tls.Conn и обёртки над ними
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite сообщение другой стороне о конце данных. Соединение без
+// закрытия в одну сторону остаётся открытым до завершения сессии
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// handleClient обработка входящего соединения
+func (s *Server) handleClient(conn net.Conn, policy *ListenerPolicy) {
+	defer conn.Close()
+	defer s.admission.release(conn.RemoteAddr())
+
+	sess := &session{srv: s, conn: conn}
+	sess.policy = policy
+	sess.begin(s.sessionIDs.Add(1))
+	s.registry.add(sess)
+	defer s.registry.remove(sess)
+	defer func() { s.logAccess(sess.record(conn.RemoteAddr(), sess.user)) }()
+
+	s.logf("New connection from %s (session %d)", conn.RemoteAddr().String(), sess.id)
+
+	// Рукопожатие, включая согласование TLS, должно уложиться в отведённое время
+	if s.Timeouts.Handshake > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeouts.Handshake))
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && !s.tlsHandshake(sess, tlsConn) {
+		return
+	}
+
+	cmd, address, ok := s.handshake(sess)
+	if !ok {
+		s.logf("Reading request failed")
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	s.serveRequest(sess, cmd, address)
+}
+
+// authenticateAndServe продолжение рукопожатия SOCKS5, начатого событийным циклом,
+// с методом auth: аутентификация, запрос и выполнение команды
+func (s *Server) authenticateAndServe(sess *session, auth Authenticator) {
+	conn := sess.conn
+	if s.Timeouts.Handshake > 0 {
+		_ = conn.SetDeadline(sess.started.Add(s.Timeouts.Handshake))
+	}
+
+	if !s.authenticate(sess, auth) {
+		return
+	}
+	cmd, address, ok := s.readRequest(sess)
+	if !ok {
+		s.logf("Reading request failed")
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	s.serveRequest(sess, cmd, address)
+}
+
+// serveRequest выполнение команды клиента после разбора запроса
+func (s *Server) serveRequest(sess *session, cmd byte, address string) {
+	sess.setRequest(cmd, address)
+
+	var targetConn net.Conn
+	switch cmd {
+	case UDPAssociate:
+		s.udpAssociate(sess, address)
+		return
+	case Bind:
+		targetConn = s.bindRemote(sess, address)
+	default:
+		targetConn = s.connectToRemote(sess, address)
+	}
+	if targetConn == nil {
+		s.logf("Target connection failed")
+		return
+	}
+	defer targetConn.Close()
+
+	limit := s.buckets.newSessionLimiter(sess.conn.RemoteAddr(), sess.user)
+	defer limit.release()
+
+	s.transferData(sess.conn, targetConn, &sess.bytes, limit)
+}
@@ -0,0 +1,156 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const relayBufferSize = 32 * 1024 // буфер пересылки одного направления
+
+// Направления пересылки данных
+const (
+	directionUp   = iota // от клиента к удалённому узлу
+	directionDown        // от удалённого узла к клиенту
+)
+
+// Timeouts ограничения времени для сессий, нулевое значение - без ограничения
+type Timeouts struct {
+	Handshake time.Duration // на приветствие, аутентификацию и запрос
+	Dial      time.Duration // на подключение к удалённому узлу
+	IdleUp    time.Duration // простой направления от клиента
+	IdleDown  time.Duration // простой направления к клиенту
+}
+
+// errIdleTimeout туннель простаивает дольше допустимого
+var errIdleTimeout = errors.New("idle timeout")
+
+// idleTracker учёт активности направлений туннеля.
+// Направления проверяются независимо: туннель простаивает, как только одно
+// из направлений с заданным ограничением не передавало данных дольше своего
+// ограничения. Завершённое направление (источник закрыл передачу) не проверяется
+type idleTracker struct {
+	limits       [2]time.Duration
+	lastActivity [2]atomic.Int64 // время последней передачи, UnixNano
+	finished     [2]atomic.Bool
+}
+
+func newIdleTracker(timeouts Timeouts) *idleTracker {
+	t := &idleTracker{limits: [2]time.Duration{timeouts.IdleUp, timeouts.IdleDown}}
+	now := time.Now().UnixNano()
+	t.lastActivity[directionUp].Store(now)
+	t.lastActivity[directionDown].Store(now)
+	return t
+}
+
+// touch отметка о передаче данных в направлении dir
+func (t *idleTracker) touch(dir int) {
+	t.lastActivity[dir].Store(time.Now().UnixNano())
+}
+
+// finish отметка о завершении направления dir: источник закрыл передачу
+// и все его данные доставлены
+func (t *idleTracker) finish(dir int) {
+	t.finished[dir].Store(true)
+}
+
+// expired простаивает ли направление dir дольше своего ограничения
+func (t *idleTracker) expired(dir int, now time.Time) bool {
+	limit := t.limits[dir]
+	if limit <= 0 || t.finished[dir].Load() {
+		return false
+	}
+	return now.Sub(time.Unix(0, t.lastActivity[dir].Load())) >= limit
+}
+
+// idle простаивает ли хотя бы одно направление дольше своего ограничения
+func (t *idleTracker) idle(now time.Time) bool {
+	return t.expired(directionUp, now) || t.expired(directionDown, now)
+}
+
+// copy пересылка данных направления dir с контролем его простоя и ограничением скорости.
+// Простой другого направления проверяет его собственная пересылка.
+// count получает количество переданных байт по мере передачи
+func (t *idleTracker) copy(dst, src net.Conn, dir int, limit *sessionLimiter, count func(n int64)) (int64, error) {
+	timeout := t.limits[dir]
+	if timeout <= 0 && limit == nil {
+		return io.Copy(countingWriter{w: dst, count: count}, src)
+	}
+
+	var written int64
+	buf := make([]byte, limit.chunk(dir))
+	for {
+		if timeout > 0 {
+			err := src.SetReadDeadline(time.Now().Add(timeout))
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch(dir)
+
+			// Превышение скорости сглаживается паузой перед отправкой
+			if wait := limit.take(dir, n); wait > 0 {
+				time.Sleep(wait)
+			}
+
+			// Медленный получатель активен, пока запись продвигается;
+			// получатель, не принявший ничего за всё ограничение, считается простоем
+			for off := 0; off < n; {
+				if timeout > 0 {
+					werr := dst.SetWriteDeadline(time.Now().Add(timeout))
+					if werr != nil {
+						return written, werr
+					}
+				}
+				m, werr := dst.Write(buf[off:n])
+				off += m
+				written += int64(m)
+				count(int64(m))
+				if m > 0 {
+					t.touch(dir)
+				}
+				if errors.Is(werr, os.ErrDeadlineExceeded) && m > 0 {
+					continue
+				}
+				if errors.Is(werr, os.ErrDeadlineExceeded) {
+					return written, errIdleTimeout
+				}
+				if werr != nil {
+					return written, werr
+				}
+			}
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if t.expired(dir, time.Now()) {
+				return written, errIdleTimeout
+			}
+			continue
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// countingWriter запись с учётом переданных байт после каждой записи,
+// чтобы счётчики активной сессии росли по ходу передачи
+type countingWriter struct {
+	w     io.Writer
+	count func(n int64)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count(int64(n))
+	return n, err
+}
@@ -0,0 +1,83 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// LoadTLSConfig настройки TLS-листенера по сертификату и ключу сервера.
+// Непустой clientCAFile включает проверку клиентских сертификатов этими CA:
+// с requireClientCert клиент без сертификата не допускается, без него -
+// проходит обычную аутентификацию SOCKS
+func LoadTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		if requireClientCert {
+			return nil, errors.New("client certificates cannot be required without a client CA")
+		}
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ServeTLS приём TLS-соединений из listener с настройками TLSConfig.
+// Субъект проверенного клиентского сертификата становится именем пользователя сессии
+func (s *Server) ServeTLS(listener net.Listener) error {
+	if s.TLSConfig == nil {
+		return errors.New("socks5: TLSConfig is not set")
+	}
+	return s.ServeWithPolicy(listener, &ListenerPolicy{TLSConfig: s.TLSConfig})
+}
+
+// tlsHandshake согласование TLS и определение личности клиента по сертификату
+func (s *Server) tlsHandshake(sess *session, conn *tls.Conn) bool {
+	err := conn.Handshake()
+	if err != nil {
+		s.logf("TLS handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+		s.metrics.handshakeFailed(failTLS)
+		return false
+	}
+
+	// Учитываются только сертификаты, прошедшие проверку по ClientCAs
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) > 0 {
+		sess.identity = certIdentity(state.VerifiedChains[0][0])
+		sess.setUser(sess.identity)
+		s.logf("TLS client %s identified as %q", conn.RemoteAddr().String(), sess.identity)
+	}
+	return true
+}
+
+// certIdentity имя пользователя по субъекту сертификата: CN, а без него - полное имя субъекта
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
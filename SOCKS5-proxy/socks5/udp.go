@@ -0,0 +1,200 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const udpBufferSize = 65535 // максимальный размер UDP-датаграммы
+
+// udpAssociate обработка команды UDP ASSOCIATE.
+// Ассоциация живёт, пока открыто управляющее TCP-соединение
+func (s *Server) udpAssociate(sess *session, address string) {
+	conn := sess.conn
+
+	// Порт, с которого клиент собирается отправлять датаграммы (0 - неизвестен)
+	_, portStr, _ := net.SplitHostPort(address)
+	expectedPort, _ := strconv.Atoi(portStr)
+
+	// Релей работает только для клиентов, подключившихся по TCP
+	clientAddrTCP, okRemote := conn.RemoteAddr().(*net.TCPAddr)
+	localAddrTCP, okLocal := conn.LocalAddr().(*net.TCPAddr)
+	if !okRemote || !okLocal {
+		s.logf("UDP ASSOCIATE is not supported over %s connections", conn.LocalAddr().Network())
+		connectedSend(sess, NotSupportedCommand)
+		return
+	}
+	clientIP := clientAddrTCP.IP
+
+	// При заданном пуле исходящих адресов релей открывается на адресе из пула
+	// того же семейства, что и адрес, на котором клиент достучался до прокси
+	var laddr *net.UDPAddr
+	if egress := s.egressFor(nil, sess.policy, sess.user); egress != nil {
+		ip := egress.pick(localAddrTCP.String())
+		if ip == nil {
+			s.logf("Error opening UDP relay for %s: no egress address for %s", conn.RemoteAddr().String(), localAddrTCP.String())
+			connectedSend(sess, Failed)
+			return
+		}
+		laddr = &net.UDPAddr{IP: ip}
+	}
+
+	relay, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		s.logf("Error opening UDP relay for %s: %v", conn.RemoteAddr().String(), err)
+		connectedSend(sess, Failed)
+		return
+	}
+	defer relay.Close()
+	sess.track(relay)
+
+	// Клиенту сообщаем адрес релея; если он слушает на всех интерфейсах -
+	// адрес, на котором клиент достучался до прокси
+	bndAddr := &net.UDPAddr{
+		IP:   localAddrTCP.IP,
+		Port: relay.LocalAddr().(*net.UDPAddr).Port,
+	}
+	if laddr != nil {
+		bndAddr.IP = laddr.IP
+	}
+	sendReply(sess, Succeeded, bndAddr)
+	s.logf("UDP relay %s opened for %s", bndAddr.String(), conn.RemoteAddr().String())
+
+	// Закрытие управляющего соединения завершает ассоциацию
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	var clientAddr *net.UDPAddr // фиксируется первой датаграммой от клиента
+	buf := make([]byte, udpBufferSize)
+
+	// Ассоциация закрывается, как только одно из направлений простаивает
+	// дольше своего ограничения; проверка - с шагом меньшего из ограничений
+	idle := newIdleTracker(s.Timeouts)
+	checkEvery := s.Timeouts.IdleUp
+	if checkEvery <= 0 || (s.Timeouts.IdleDown > 0 && s.Timeouts.IdleDown < checkEvery) {
+		checkEvery = s.Timeouts.IdleDown
+	}
+
+	for {
+		if checkEvery > 0 {
+			_ = relay.SetReadDeadline(time.Now().Add(checkEvery))
+		}
+
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if !idle.idle(time.Now()) {
+					continue
+				}
+				s.logf("Closing idle UDP relay %s for %s", bndAddr.String(), conn.RemoteAddr().String())
+			} else if !errors.Is(err, net.ErrClosed) {
+				s.logf("Error reading from UDP relay %s: %v", bndAddr.String(), err)
+			}
+			break
+		}
+
+		fromClient := false
+		if clientAddr != nil {
+			fromClient = from.IP.Equal(clientAddr.IP) && from.Port == clientAddr.Port
+		} else if from.IP.Equal(clientIP) && (expectedPort == 0 || from.Port == expectedPort) {
+			clientAddr = from
+			fromClient = true
+		}
+
+		if fromClient {
+			idle.touch(directionUp)
+			s.relayToRemote(sess, relay, buf[:n])
+			continue
+		}
+
+		// Датаграммы до появления клиента отправить некуда
+		if clientAddr == nil {
+			continue
+		}
+
+		// Ответ удалённого узла: оборачиваем в заголовок с его адресом
+		packet := append([]byte{Null, Null, Null}, encodeAddr(from)...)
+		packet = append(packet, buf[:n]...)
+		_, err = relay.WriteToUDP(packet, clientAddr)
+		if err != nil {
+			s.logf("Error writing to %s: %v", clientAddr.String(), err)
+			continue
+		}
+		idle.touch(directionDown)
+		sess.bytes[directionDown].Add(int64(n))
+	}
+
+	s.logf("UDP relay %s closed for %s", bndAddr.String(), conn.RemoteAddr().String())
+}
+
+// relayToRemote разбор датаграммы клиента и отправка данных адресату
+func (s *Server) relayToRemote(sess *session, relay *net.UDPConn, packet []byte) {
+	frag, address, data, err := parseUDPHeader(packet)
+	if err != nil {
+		s.logf("Dropping malformed UDP datagram: %v", err)
+		return
+	}
+
+	// Фрагментация не поддерживается: такие датаграммы отбрасываются (RFC 1928, раздел 7)
+	if frag != 0x00 {
+		s.logf("Dropping fragmented UDP datagram to %s (frag %x)", address, frag)
+		return
+	}
+
+	_, addresses, err := s.checkAccess(sess.conn.RemoteAddr(), sess.user, address)
+	if err != nil {
+		return
+	}
+
+	// Имя, проверенное правилами доступа, повторно не разрешается
+	if addresses == nil {
+		addresses, err = s.Resolver.ResolveAddress(address)
+		if err != nil {
+			s.logf("Error resolving %s: %v", address, err)
+			return
+		}
+	}
+
+	target, err := net.ResolveUDPAddr("udp", addresses[0])
+	if err != nil {
+		s.logf("Error resolving %s: %v", address, err)
+		return
+	}
+
+	_, err = relay.WriteToUDP(data, target)
+	if err != nil {
+		s.logf("Error writing to %s: %v", target.String(), err)
+		return
+	}
+	sess.bytes[directionUp].Add(int64(len(data)))
+}
+
+// parseUDPHeader разбор заголовка UDP-запроса SOCKS5.
+// Возвращает номер фрагмента, адрес назначения "host:port" и полезные данные
+func parseUDPHeader(packet []byte) (byte, string, []byte, error) {
+	/*
+		+----+------+------+----------+----------+----------+
+		|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		+----+------+------+----------+----------+----------+
+		| 2  |  1   |  1   | Variable |    2     | Variable |
+		+----+------+------+----------+----------+----------+
+	*/
+
+	if len(packet) < 3 {
+		return 0, "", nil, fmt.Errorf("datagram too short: %d bytes", len(packet))
+	}
+
+	address, n, err := parseAddr(packet[3:])
+	if err != nil {
+		return 0, "", nil, err
+	}
+
+	return packet[2], address, packet[3+n:], nil
+}
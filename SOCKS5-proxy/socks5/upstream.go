@@ -0,0 +1,340 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"SOCKS5-proxy/socks5/client"
+)
+
+// Dialer исходящее подключение к целевому адресу: напрямую или через вышестоящий прокси
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// upstreamError отказ вышестоящего прокси с кодом ответа SOCKS5 для клиента
+type upstreamError struct {
+	rep byte
+	msg string
+}
+
+func (e *upstreamError) Error() string { return e.msg }
+
+// DirectDialer прямое подключение с перебором разрешённых IP-адресов.
+// Пул исходящих адресов из контекста ограничивает перебор адресами тех семейств,
+// для которых в пуле есть исходящий адрес
+type DirectDialer struct {
+	Resolver *Resolver // резолвер доменных имён, nil - системный
+}
+
+func (d DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// Имя, проверенное правилами доступа, повторно не разрешается
+	var err error
+	addresses := checkedFrom(ctx, address)
+	if addresses == nil {
+		addresses, err = d.Resolver.ResolveAddress(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool := egressFrom(ctx)
+	for _, addr := range addresses {
+		var d net.Dialer
+		if pool != nil {
+			ip := pool.pick(addr)
+			if ip == nil {
+				err = fmt.Errorf("no egress address for %s", addr)
+				continue
+			}
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (DirectDialer) String() string { return "direct" }
+
+// socks5Dialer подключение через вышестоящий SOCKS5-прокси
+type socks5Dialer struct {
+	client.Dialer
+	next Dialer // через что подключаться к самому прокси
+}
+
+func newSOCKS5Dialer(proxy, user, password string, next Dialer) *socks5Dialer {
+	return &socks5Dialer{
+		Dialer: client.Dialer{ProxyAddress: proxy, Username: user, Password: password, Forward: next},
+		next:   next,
+	}
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", d.ProxyAddress, err)
+	}
+	return conn, nil
+}
+
+// setHandshakeDeadline ограничение обмена с вышестоящим прокси сроком подключения
+func setHandshakeDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+}
+
+func (d *socks5Dialer) String() string { return hopString(d.next, "socks5://"+d.ProxyAddress) }
+
+// httpConnectDialer подключение через HTTP-прокси методом CONNECT
+type httpConnectDialer struct {
+	proxy    string
+	user     string
+	password string
+	next     Dialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.next.DialContext(ctx, network, d.proxy)
+	if err != nil {
+		return nil, err
+	}
+	setHandshakeDeadline(ctx, conn)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		conn.Close()
+		return nil, &upstreamError{
+			rep: httpStatusReply(resp.StatusCode),
+			msg: fmt.Sprintf("upstream %s replied %q for %s", d.proxy, resp.Status, address),
+		}
+	}
+
+	// Прокси мог прислать данные сразу за заголовками
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (d *httpConnectDialer) String() string { return hopString(d.next, "http://"+d.proxy) }
+
+// httpStatusReply код ответа SOCKS5, соответствующий отказу HTTP-прокси
+func httpStatusReply(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return NotAllowed
+	case http.StatusGatewayTimeout:
+		return TTLExpired
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return HostUnreachable
+	default:
+		return Failed
+	}
+}
+
+// bufferedConn соединение с данными, уже прочитанными в буфер
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// ParseChain построение цепочки прокси по списку переходов.
+// Переход: "direct", "socks5://[user:pass@]host:port" или "http://[user:pass@]host:port";
+// первый переход подключается через base (nil - напрямую), каждый следующий - через предыдущий
+func ParseChain(hops []string, base Dialer) (Dialer, error) {
+	d := base
+	if d == nil {
+		d = DirectDialer{}
+	}
+
+	for _, hop := range hops {
+		if hop == "direct" {
+			continue
+		}
+
+		u, err := url.Parse(hop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %v", hop, err)
+		}
+		if u.Port() == "" {
+			return nil, fmt.Errorf("upstream %q has no port", hop)
+		}
+		user := u.User.Username()
+		password, _ := u.User.Password()
+
+		switch u.Scheme {
+		case "socks5":
+			d = newSOCKS5Dialer(u.Host, user, password, d)
+		case "http":
+			d = &httpConnectDialer{proxy: u.Host, user: user, password: password, next: d}
+		default:
+			return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+		}
+	}
+
+	return d, nil
+}
+
+// hopString описание перехода вместе с предшествующей частью цепочки
+func hopString(next Dialer, hop string) string {
+	if _, ok := next.(DirectDialer); ok {
+		return hop
+	}
+	return fmt.Sprint(next) + " -> " + hop
+}
+
+// route маршрут: назначения и цепочка прокси для них
+type route struct {
+	hosts  []string
+	nets   []*net.IPNet
+	dialer Dialer
+	line   int
+}
+
+// RouteTable таблица маршрутов, применяется первый совпавший.
+// Сама является Dialer, подключаясь по выбранному маршруту
+type RouteTable struct {
+	routes   []*route
+	fallback Dialer // маршрут по умолчанию
+}
+
+// LoadRoutes чтение файла маршрутов.
+// Формат строки: "pattern[,pattern...] hop [hop...]", где pattern - шаблон имени
+// как в правилах доступа, IP или CIDR, либо "default" для маршрута по умолчанию.
+// Цепочки строятся поверх base, маршрут по умолчанию без строки "default" - fallback
+func LoadRoutes(filename string, fallback, base Dialer) (*RouteTable, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rt := &RouteTable{fallback: fallback}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"pattern hop [hop...]\"", filename, lineNum)
+		}
+		dialer, err := ParseChain(fields[1:], base)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+
+		if fields[0] == "default" {
+			rt.fallback = dialer
+			continue
+		}
+
+		r := &route{dialer: dialer, line: lineNum}
+		for _, pattern := range strings.Split(fields[0], ",") {
+			if strings.Contains(pattern, "/") || net.ParseIP(pattern) != nil {
+				ipNet, err := parseCIDR(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+				}
+				r.nets = append(r.nets, ipNet)
+			} else {
+				r.hosts = append(r.hosts, strings.ToLower(pattern))
+			}
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// Len количество маршрутов, не считая маршрута по умолчанию
+func (rt *RouteTable) Len() int {
+	return len(rt.routes)
+}
+
+// Fallback маршрут по умолчанию
+func (rt *RouteTable) Fallback() Dialer {
+	return rt.fallback
+}
+
+func (rt *RouteTable) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return rt.DialerFor(address).DialContext(ctx, network, address)
+}
+
+// DialerFor выбор цепочки для целевого адреса
+func (rt *RouteTable) DialerFor(address string) Dialer {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return rt.fallback
+	}
+	ip := net.ParseIP(host)
+
+	for _, r := range rt.routes {
+		for _, pattern := range r.hosts {
+			if matchHost(pattern, host) {
+				return r.dialer
+			}
+		}
+		if ip != nil && containsIP(r.nets, ip) {
+			return r.dialer
+		}
+	}
+	return rt.fallback
+}